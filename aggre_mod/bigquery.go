@@ -0,0 +1,315 @@
+// bigquery.go implements a Sink that streams readings into a BigQuery table
+// with the tabledata.insertAll API, without going through Fluentd.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bigQueryDefaultEndpoint = "https://bigquery.googleapis.com/bigquery/v2"
+	bigQueryScope           = "https://www.googleapis.com/auth/bigquery.insertdata"
+
+	// insertAll accepts requests of up to 10 MB and recommends at most 500
+	// rows per request. Larger batches are split into several requests.
+	bigQueryMaxRequestRows  = 500
+	bigQueryMaxRequestBytes = 10 << 20
+	// The space reserved for the request apart from the rows.
+	bigQueryRequestOverhead = 1024
+)
+
+// The reasons of row errors that may succeed if the row is inserted again.
+// Rows are stopped when another row in the request is invalid.
+var bigQueryRetryReasons = map[string]bool{
+	"backendError":      true,
+	"internalError":     true,
+	"rateLimitExceeded": true,
+	"stopped":           true,
+	"timeout":           true,
+}
+
+// bigQueryConfig configures a BigQuery sink.
+type bigQueryConfig struct {
+	// Endpoint is the base URL of the BigQuery API. It can be changed to
+	// test against a local server.
+	Endpoint string
+	Project  string
+	Dataset  string
+	Table    string
+	// Tokens authenticates requests. If nil, requests are sent without
+	// credentials.
+	Tokens *googleTokenSource
+	// The number of rows sent in a single request.
+	BatchSize int
+	// The number of times failed rows are retried.
+	Retries   int
+	RetryWait time.Duration
+}
+
+// bigQueryRow is a row of an insertAll request.
+type bigQueryRow struct {
+	InsertId string                 `json:"insertId"`
+	Json     map[string]interface{} `json:"json"`
+}
+
+// bigQueryInsertResponse is the response to an insertAll request.
+type bigQueryInsertResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+// bigQuerySink batches readings as rows and inserts them into BigQuery.
+type bigQuerySink struct {
+	config    bigQueryConfig
+	insertURL string
+	client    *http.Client
+	// The limits of a single insertAll request.
+	maxRequestRows  int
+	maxRequestBytes int
+
+	mu   sync.Mutex
+	rows []bigQueryRow
+	// The error returned by the last insert, if any.
+	lastErr error
+}
+
+// newBigQuerySink creates a sink that inserts into the table described by
+// config.
+func newBigQuerySink(config bigQueryConfig) (*bigQuerySink, error) {
+	if config.Project == "" || config.Dataset == "" || config.Table == "" {
+		return nil, errors.New("a project, dataset and table are required")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+
+	return &bigQuerySink{
+		config: config,
+		insertURL: fmt.Sprintf("%s/projects/%s/datasets/%s/tables/%s/insertAll",
+			strings.TrimRight(stringDefaults(bigQueryDefaultEndpoint, config.Endpoint), "/"),
+			url.PathEscape(config.Project), url.PathEscape(config.Dataset), url.PathEscape(config.Table)),
+		client:          &http.Client{Timeout: 30 * time.Second},
+		maxRequestRows:  bigQueryMaxRequestRows,
+		maxRequestBytes: bigQueryMaxRequestBytes,
+	}, nil
+}
+
+func (s *bigQuerySink) Name() string {
+	return "bigquery"
+}
+
+// bigQueryInsertId returns the insert ID of a record without a record ID.
+// BigQuery drops rows with an insert ID it has seen in the last few minutes,
+// so records that are sent again, e.g. when retrying or replaying, are only
+// stored once.
+func bigQueryInsertId(record map[string]interface{}) (string, error) {
+	// Maps are encoded with sorted keys so equal records have equal IDs.
+	b, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Write adds a reading to the current batch and sends the batch if it is
+// full.
+func (s *bigQuerySink) Write(r *Reading) error {
+	record := r.Record()
+	id := r.Id
+	if id == "" {
+		var err error
+		if id, err = bigQueryInsertId(record); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rows = append(s.rows, bigQueryRow{InsertId: id, Json: record})
+	if len(s.rows) < s.config.BatchSize {
+		return nil
+	}
+	return s.flush()
+}
+
+// Flush sends the current batch.
+func (s *bigQuerySink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// flush sends the current batch, retrying failed rows. Rows are dropped if
+// they can't be inserted. s.mu must be held.
+func (s *bigQuerySink) flush() error {
+	if len(s.rows) == 0 {
+		return nil
+	}
+
+	pending := s.rows
+	dropped := 0
+	backoff := s.config.RetryWait
+	var err error
+	for i := 0; i <= s.config.Retries && len(pending) > 0; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		requests, tooLarge := s.split(pending)
+		for _, row := range tooLarge {
+			log.Printf("BigQuery row of %v at %v is too large to be inserted", row.Json["deviceid"], row.Json["timestamp"])
+			err = errors.New("row too large")
+		}
+		dropped += len(tooLarge)
+		pending = nil
+		for _, rows := range requests {
+			retry, failed, insertErr := s.insert(rows)
+			pending = append(pending, retry...)
+			dropped += failed
+			if insertErr != nil {
+				err = insertErr
+			}
+		}
+	}
+	dropped += len(pending)
+	if dropped > 0 {
+		err = fmt.Errorf("dropped %d of %d rows: %v", dropped, len(s.rows), err)
+	} else {
+		err = nil
+	}
+
+	s.rows = nil
+	s.lastErr = err
+	return err
+}
+
+// split splits rows into the rows of requests that are within the request
+// limits. Rows that exceed the size limit on their own are returned
+// separately.
+func (s *bigQuerySink) split(rows []bigQueryRow) (requests [][]bigQueryRow, tooLarge []bigQueryRow) {
+	var request []bigQueryRow
+	size := bigQueryRequestOverhead
+	for _, row := range rows {
+		// A row that can't be encoded fails with its request.
+		b, _ := json.Marshal(row)
+		if bigQueryRequestOverhead+len(b) > s.maxRequestBytes {
+			tooLarge = append(tooLarge, row)
+			continue
+		}
+		// Rows are separated by commas.
+		if len(request) == s.maxRequestRows || size+len(b)+1 > s.maxRequestBytes {
+			requests = append(requests, request)
+			request = nil
+			size = bigQueryRequestOverhead
+		}
+		request = append(request, row)
+		size += len(b) + 1
+	}
+	if len(request) > 0 {
+		requests = append(requests, request)
+	}
+	return requests, tooLarge
+}
+
+// insert sends rows to the insertAll endpoint. It returns the rows that
+// failed and may succeed if retried and the number of rows that failed and
+// can't be inserted.
+func (s *bigQuerySink) insert(rows []bigQueryRow) (retry []bigQueryRow, failed int, err error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"kind":            "bigquery#tableDataInsertAllRequest",
+		"skipInvalidRows": true,
+		"rows":            rows,
+	})
+	if err != nil {
+		return nil, len(rows), err
+	}
+	req, err := http.NewRequest("POST", s.insertURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, len(rows), err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.Tokens != nil {
+		token, err := s.config.Tokens.Token()
+		if err != nil {
+			return rows, 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return rows, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+
+	if resp.StatusCode/100 != 2 {
+		msg := respBody
+		if len(msg) > 1024 {
+			msg = msg[:1024]
+		}
+		err = fmt.Errorf("BigQuery returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		// Retry server errors and rate limiting. Other client errors, e.g.
+		// a missing table, fail again if retried.
+		if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+			return rows, 0, err
+		}
+		return nil, len(rows), err
+	}
+
+	var result bigQueryInsertResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		// Rows that were inserted are dropped by BigQuery if they are sent
+		// again so all of them can be retried.
+		return rows, 0, fmt.Errorf("could not parse BigQuery response: %v", err)
+	}
+	for _, ie := range result.InsertErrors {
+		if ie.Index < 0 || ie.Index >= len(rows) || len(ie.Errors) == 0 {
+			continue
+		}
+		row := rows[ie.Index]
+		if bigQueryRetryReasons[ie.Errors[0].Reason] {
+			retry = append(retry, row)
+			continue
+		}
+		failed++
+		log.Printf("BigQuery rejected row of %v at %v: %s: %s", row.Json["deviceid"], row.Json["timestamp"], ie.Errors[0].Reason, ie.Errors[0].Message)
+		err = fmt.Errorf("%s: %s", ie.Errors[0].Reason, ie.Errors[0].Message)
+	}
+	if err == nil && len(retry) > 0 {
+		err = fmt.Errorf("%d rows could not be inserted", len(retry))
+	}
+	return retry, failed, err
+}
+
+// Close sends the current batch.
+func (s *bigQuerySink) Close() error {
+	return s.Flush()
+}
+
+// Health returns the error of the last insert.
+func (s *bigQuerySink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
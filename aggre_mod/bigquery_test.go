@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testBigQueryServer is an insertAll endpoint that records the rows of each
+// request and replies with the given responses in turn. The last response
+// is repeated.
+type testBigQueryServer struct {
+	*httptest.Server
+	t *testing.T
+
+	mu        sync.Mutex
+	responses []testBigQueryResponse
+	requests  [][]bigQueryRow
+	auth      []string
+}
+
+type testBigQueryResponse struct {
+	status int
+	body   string
+}
+
+func newTestBigQueryServer(t *testing.T, responses ...testBigQueryResponse) *testBigQueryServer {
+	s := &testBigQueryServer{t: t, responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testBigQueryServer) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || req.URL.Path != "/projects/proj/datasets/weather/tables/readings/insertAll" {
+		s.t.Errorf("request to %s %s", req.Method, req.URL.Path)
+	}
+	var body struct {
+		Rows []bigQueryRow `json:"rows"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		s.t.Errorf("invalid request: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, body.Rows)
+	s.auth = append(s.auth, req.Header.Get("Authorization"))
+	resp := testBigQueryResponse{http.StatusOK, "{}"}
+	if len(s.responses) > 0 {
+		resp = s.responses[0]
+		if len(s.responses) > 1 {
+			s.responses = s.responses[1:]
+		}
+	}
+	w.WriteHeader(resp.status)
+	fmt.Fprint(w, resp.body)
+}
+
+// devices returns the device IDs of the rows of each request.
+func (s *testBigQueryServer) devices() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := []string{}
+	for _, rows := range s.requests {
+		ids := []string{}
+		for _, row := range rows {
+			ids = append(ids, fmt.Sprint(row.Json["deviceid"]))
+		}
+		requests = append(requests, strings.Join(ids, ","))
+	}
+	return requests
+}
+
+func newTestBigQuerySink(t *testing.T, server *testBigQueryServer, batchSize int) *bigQuerySink {
+	s, err := newBigQuerySink(bigQueryConfig{
+		Endpoint:  server.URL + "/",
+		Project:   "proj",
+		Dataset:   "weather",
+		Table:     "readings",
+		BatchSize: batchSize,
+		Retries:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestBigQuerySinkBatches(t *testing.T) {
+	server := newTestBigQueryServer(t)
+	s := newTestBigQuerySink(t, server, 2)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.Write(&Reading{DeviceId: id, Timestamp: 1500000000, Values: map[string]float64{"temp": 20}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fmt.Sprint(server.devices()); got != "[a,b]" {
+		t.Errorf("sent %s before flushing, want [a,b]", got)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(server.devices()); got != "[a,b c]" {
+		t.Errorf("sent %s, want [a,b c]", got)
+	}
+	if err := s.Health(); err != nil {
+		t.Errorf("Health() = %v", err)
+	}
+}
+
+// Rows are sent with an insert ID so that BigQuery stores records that are
+// sent again only once.
+func TestBigQueryInsertId(t *testing.T) {
+	server := newTestBigQueryServer(t)
+	s := newTestBigQuerySink(t, server, 10)
+	readings := []*Reading{
+		{DeviceId: "a", Timestamp: 1500000000, Values: map[string]float64{"temp": 20}},
+		{DeviceId: "a", Timestamp: 1500000000, Values: map[string]float64{"temp": 20}},
+		{DeviceId: "a", Timestamp: 1500000060, Values: map[string]float64{"temp": 20}},
+		{DeviceId: "a", Timestamp: 1500000000, Values: map[string]float64{"temp": 20}, Id: "particle-123"},
+	}
+	for _, r := range readings {
+		if err := s.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := server.requests[0]
+	if len(rows) != len(readings) {
+		t.Fatalf("sent %d rows, want %d", len(rows), len(readings))
+	}
+	if rows[0].InsertId == "" || rows[0].InsertId != rows[1].InsertId {
+		t.Errorf("equal records have insert IDs %q and %q", rows[0].InsertId, rows[1].InsertId)
+	}
+	if rows[0].InsertId == rows[2].InsertId {
+		t.Errorf("different records have the same insert ID %q", rows[0].InsertId)
+	}
+	if rows[3].InsertId != "particle-123" {
+		t.Errorf("record with ID particle-123 has insert ID %q", rows[3].InsertId)
+	}
+}
+
+func TestBigQuerySinkErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []testBigQueryResponse
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:      "ok",
+			responses: []testBigQueryResponse{{200, `{"kind":"bigquery#tableDataInsertAllResponse"}`}},
+			want:      []string{"a,b,c"},
+		},
+		{
+			name: "row errors",
+			responses: []testBigQueryResponse{
+				{200, `{"insertErrors":[` +
+					`{"index":0,"errors":[{"reason":"invalid","message":"no such field"}]},` +
+					`{"index":1,"errors":[{"reason":"stopped"}]},` +
+					`{"index":2,"errors":[{"reason":"backendError"}]}]}`},
+				{200, `{}`},
+			},
+			want:    []string{"a,b,c", "b,c"},
+			wantErr: "dropped 1 of 3 rows: invalid: no such field",
+		},
+		{
+			name: "rows keep failing",
+			responses: []testBigQueryResponse{
+				{200, `{"insertErrors":[{"index":1,"errors":[{"reason":"timeout"}]}]}`},
+				{200, `{"insertErrors":[{"index":0,"errors":[{"reason":"timeout"}]}]}`},
+			},
+			want:    []string{"a,b,c", "b", "b"},
+			wantErr: "dropped 1 of 3 rows: 1 rows could not be inserted",
+		},
+		{
+			name:      "server error",
+			responses: []testBigQueryResponse{{503, "unavailable"}, {200, `{}`}},
+			want:      []string{"a,b,c", "a,b,c"},
+		},
+		{
+			name:      "rate limited",
+			responses: []testBigQueryResponse{{429, "slow down"}},
+			want:      []string{"a,b,c", "a,b,c", "a,b,c"},
+			wantErr:   "dropped 3 of 3 rows: BigQuery returned 429 Too Many Requests: slow down",
+		},
+		{
+			name:      "client error",
+			responses: []testBigQueryResponse{{404, "no such table"}},
+			want:      []string{"a,b,c"},
+			wantErr:   "dropped 3 of 3 rows: BigQuery returned 404 Not Found: no such table",
+		},
+		{
+			name:      "invalid response",
+			responses: []testBigQueryResponse{{200, "{"}, {200, `{}`}},
+			want:      []string{"a,b,c", "a,b,c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestBigQueryServer(t, tt.responses...)
+			s := newTestBigQuerySink(t, server, 10)
+			for _, id := range []string{"a", "b", "c"} {
+				if err := s.Write(&Reading{DeviceId: id, Timestamp: 1500000000}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := s.Flush()
+			if fmt.Sprint(server.devices()) != fmt.Sprint(tt.want) {
+				t.Errorf("sent %v, want %v", server.devices(), tt.want)
+			}
+			if got := fmt.Sprint(err); tt.wantErr == "" && err != nil || tt.wantErr != "" && got != tt.wantErr {
+				t.Errorf("Flush() = %v, want %s", err, stringDefaults("nil", tt.wantErr))
+			}
+			if fmt.Sprint(s.Health()) != fmt.Sprint(err) {
+				t.Errorf("Health() = %v, want %v", s.Health(), err)
+			}
+			// Dropped rows aren't sent again.
+			if err := s.Flush(); err != nil {
+				t.Errorf("second Flush() = %v", err)
+			}
+			if got := len(server.devices()); got != len(tt.want) {
+				t.Errorf("sent %d requests after flushing again, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
+
+// Requests are authenticated with an access token from the token endpoint.
+func TestBigQuerySinkAuthentication(t *testing.T) {
+	key := testRSAKey(t)
+	tokens := newTestTokenServer(t, &key.PublicKey)
+	ts, err := loadGoogleTokenSource(writeServiceAccountKey(t, key, tokens.URL, true), bigQueryScope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestBigQueryServer(t)
+	s := newTestBigQuerySink(t, server, 1)
+	s.config.Tokens = ts
+	for i := 0; i < 2; i++ {
+		if err := s.Write(&Reading{DeviceId: "a", Timestamp: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := "[Bearer token1 Bearer token1]"; fmt.Sprint(server.auth) != want {
+		t.Errorf("requests sent with %v, want %s", server.auth, want)
+	}
+
+	// Rows aren't sent if no token can be got.
+	tokens.status = http.StatusUnauthorized
+	if s.config.Tokens, err = loadGoogleTokenSource(writeServiceAccountKey(t, key, tokens.URL, true), bigQueryScope); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(&Reading{DeviceId: "a", Timestamp: 2}); err == nil {
+		t.Error("rows were sent without a token")
+	}
+	if len(server.requests) != 2 {
+		t.Errorf("sent %d requests, want 2", len(server.requests))
+	}
+}
+
+// Batches are split into requests within the row and size limits of
+// insertAll. Rows that are too large on their own are dropped.
+func TestBigQuerySinkRequestLimits(t *testing.T) {
+	row := func(device string) bigQueryRow {
+		return bigQueryRow{InsertId: "id", Json: map[string]interface{}{"deviceid": device}}
+	}
+	b, err := json.Marshal(row("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The size of a request of two rows, separated by commas.
+	twoRows := bigQueryRequestOverhead + 2*(len(b)+1)
+
+	tests := []struct {
+		name     string
+		maxRows  int
+		maxBytes int
+		devices  []string
+		want     []string
+		tooLarge []string
+	}{
+		{"within limits", 10, twoRows * 10, []string{"a", "b", "c"}, []string{"a,b,c"}, []string{}},
+		{"row limit", 2, twoRows * 10, []string{"a", "b", "c", "d", "e"}, []string{"a,b", "c,d", "e"}, []string{}},
+		{"size limit", 10, twoRows, []string{"a", "b", "c", "d", "e"}, []string{"a,b", "c,d", "e"}, []string{}},
+		{"just over size limit", 10, twoRows - 1, []string{"a", "b", "c"}, []string{"a", "b", "c"}, []string{}},
+		{"row too large", 10, twoRows, []string{"a", strings.Repeat("x", twoRows), "b"}, []string{"a,b"}, []string{strings.Repeat("x", twoRows)}},
+		{"no rows", 10, twoRows, []string{}, []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &bigQuerySink{maxRequestRows: tt.maxRows, maxRequestBytes: tt.maxBytes}
+			rows := []bigQueryRow{}
+			for _, d := range tt.devices {
+				rows = append(rows, row(d))
+			}
+			requests, tooLarge := s.split(rows)
+
+			got := []string{}
+			for _, rows := range requests {
+				ids := []string{}
+				for _, r := range rows {
+					ids = append(ids, fmt.Sprint(r.Json["deviceid"]))
+				}
+				got = append(got, strings.Join(ids, ","))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("requests %v, want %v", got, tt.want)
+			}
+			dropped := []string{}
+			for _, r := range tooLarge {
+				dropped = append(dropped, fmt.Sprint(r.Json["deviceid"]))
+			}
+			if fmt.Sprint(dropped) != fmt.Sprint(tt.tooLarge) {
+				t.Errorf("too large %v, want %v", dropped, tt.tooLarge)
+			}
+		})
+	}
+
+	// A flush sends a request for each part of the batch.
+	server := newTestBigQueryServer(t)
+	s := newTestBigQuerySink(t, server, 10)
+	s.maxRequestRows = 2
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if err := s.Write(&Reading{DeviceId: id, Timestamp: 1500000000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(server.devices()); got != "[a,b c,d e]" {
+		t.Errorf("sent %s, want [a,b c,d e]", got)
+	}
+
+	// Rows that are too large are dropped without being sent.
+	s.maxRequestBytes = bigQueryRequestOverhead + 500
+	for _, id := range []string{"f", strings.Repeat("x", 500)} {
+		if err := s.Write(&Reading{DeviceId: id, Timestamp: 1500000000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); fmt.Sprint(err) != "dropped 1 of 2 rows: row too large" {
+		t.Errorf("Flush() = %v, want dropped 1 of 2 rows: row too large", err)
+	}
+	if got := fmt.Sprint(server.devices()); got != "[a,b c,d e f]" {
+		t.Errorf("sent %s, want [a,b c,d e f]", got)
+	}
+}
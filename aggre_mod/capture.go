@@ -0,0 +1,52 @@
+// capture.go implements capturing raw Particle API messages to rotating
+// NDJSON files so that they can be replayed later with the replay command.
+
+package main
+
+import (
+	"encoding/json"
+)
+
+const (
+	capturePrefix = "particle"
+	captureExt    = ".ndjson"
+)
+
+// captureWriter appends messages to NDJSON files in a directory. A new file
+// is started when the current one exceeds maxBytes and the oldest files are
+// removed when there are more than maxFiles.
+type captureWriter struct {
+	f *rotatingFile
+}
+
+// newCaptureWriter creates a capture writer that writes to the given
+// directory, creating it if necessary. If maxFiles is zero old files are
+// never removed.
+func newCaptureWriter(dir string, maxBytes int64, maxFiles int) (*captureWriter, error) {
+	f, err := newRotatingFile(dir, capturePrefix, captureExt, maxBytes, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &captureWriter{f: f}, nil
+}
+
+// Write appends a message to the current capture file.
+func (c *captureWriter) Write(m *Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = c.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the current capture file.
+func (c *captureWriter) Close() error {
+	return c.f.Close()
+}
+
+// captureFiles returns the capture files in the given directory, oldest
+// first.
+func captureFiles(dir string) ([]string, error) {
+	return rotatedFiles(dir, capturePrefix, captureExt)
+}
@@ -0,0 +1,178 @@
+// decode.go implements decoding of the data that devices send in Particle
+// API messages. Older firmware sends LTSV and newer firmware sends a JSON
+// object. The format is detected automatically.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/najeira/ltsv"
+)
+
+const (
+	formatLTSV = "ltsv"
+	formatJSON = "json"
+)
+
+// Reasons that device data could not be decoded other than payload errors,
+// which are labelled with the payload format.
+const (
+	reasonMessage   = "message"
+	reasonTimestamp = "timestamp"
+	reasonMetric    = "metric"
+	reasonDevice    = "device"
+)
+
+// decodeError is an error decoding device data. The reason classifies the
+// error for the pipeline metrics.
+type decodeError struct {
+	reason string
+	err    error
+}
+
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+// maxDeviceIdLength is the maximum length of a device ID in bytes. Device
+// IDs name directories in the readings store, so they must stay short of
+// the file name limit once escaped.
+const maxDeviceIdLength = 64
+
+// checkDeviceId returns an error if a device ID sent by a device can't be
+// used, e.g. as a file name in the readings store or as a tag.
+func checkDeviceId(id string) error {
+	switch {
+	case id == "":
+		return errors.New("device ID is empty")
+	case id == "." || id == "..":
+		return fmt.Errorf("invalid device ID %q", id)
+	case len(id) > maxDeviceIdLength:
+		return fmt.Errorf("device ID %q is longer than %d bytes", id, maxDeviceIdLength)
+	}
+	for _, c := range id {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("device ID %q contains a control character", id)
+		}
+	}
+	return nil
+}
+
+// decodeErrorReason returns the reason of a decoding error.
+func decodeErrorReason(err error) string {
+	if e, ok := err.(*decodeError); ok {
+		return e.reason
+	}
+	return "other"
+}
+
+// formatStats holds the number of payloads decoded in a format.
+type formatStats struct {
+	Decoded int64 `json:"decoded"`
+	Errors  int64 `json:"errors"`
+}
+
+// decodeStats counts decoded payloads and parse errors by format.
+type decodeStats struct {
+	mu      sync.Mutex
+	formats map[string]*formatStats
+}
+
+var payloadStats = &decodeStats{
+	formats: map[string]*formatStats{
+		formatLTSV: &formatStats{},
+		formatJSON: &formatStats{},
+	},
+}
+
+// record records the result of decoding a payload in the given format.
+func (s *decodeStats) record(format string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.formats[format].Errors++
+	} else {
+		s.formats[format].Decoded++
+	}
+}
+
+// snapshot returns a copy of the current counts.
+func (s *decodeStats) snapshot() map[string]formatStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]formatStats)
+	for format, stats := range s.formats {
+		counts[format] = *stats
+	}
+	return counts
+}
+
+// detectFormat returns the format of a device payload. Payloads that look
+// like a JSON object are JSON, everything else is treated as LTSV.
+func detectFormat(data string) string {
+	if strings.HasPrefix(strings.TrimSpace(data), "{") {
+		return formatJSON
+	}
+	return formatLTSV
+}
+
+// decodePayload decodes a device payload into a map of field names to
+// values and returns the detected format.
+func decodePayload(data string) (string, map[string]string, error) {
+	format := detectFormat(data)
+	var fields map[string]string
+	var err error
+	switch format {
+	case formatJSON:
+		fields, err = decodeJSON(data)
+	default:
+		fields, err = decodeLTSV(data)
+	}
+	return format, fields, err
+}
+
+// decodeLTSV reads a single LTSV record.
+func decodeLTSV(data string) (map[string]string, error) {
+	reader := ltsv.NewReader(bytes.NewBufferString(data))
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading LTSV data: %v", err)
+	}
+	if len(records) != 1 {
+		return nil, fmt.Errorf("Error reading LTSV data: expected 1 record, got %d", len(records))
+	}
+	return records[0], nil
+}
+
+// decodeJSON reads a flat JSON object. Numbers and strings are kept as
+// strings so that they are handled the same way as LTSV values. Other
+// values are ignored.
+func decodeJSON(data string) (map[string]string, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("Error reading JSON data: %v", err)
+	}
+	if obj == nil {
+		return nil, errors.New("Error reading JSON data: not an object")
+	}
+
+	fields := make(map[string]string)
+	for name, val := range obj {
+		switch v := val.(type) {
+		case json.Number:
+			fields[name] = v.String()
+		case string:
+			fields[name] = v
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"timestamp:1500000000\ttemp:21.5", formatLTSV},
+		{`{"timestamp":1500000000,"temp":21.5}`, formatJSON},
+		{" \n{\"temp\":21.5}", formatJSON},
+		{`["temp"]`, formatLTSV},
+		{"", formatLTSV},
+	}
+	for _, tt := range tests {
+		if got := detectFormat(tt.data); got != tt.want {
+			t.Errorf("detectFormat(%q) = %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		format  string
+		want    map[string]string
+		invalid bool
+	}{
+		{
+			name:   "ltsv",
+			data:   "timestamp:1500000000\ttemp:21.5\thumidity:40",
+			format: formatLTSV,
+			want:   map[string]string{"timestamp": "1500000000", "temp": "21.5", "humidity": "40"},
+		},
+		{
+			name:   "json",
+			data:   `{"timestamp":1500000000,"temp":21.5,"humidity":40}`,
+			format: formatJSON,
+			want:   map[string]string{"timestamp": "1500000000", "temp": "21.5", "humidity": "40"},
+		},
+		{
+			name:   "json keeps number text",
+			data:   `{"timestamp":1500000000,"pressure":1013.250,"rainfall":1e-1}`,
+			format: formatJSON,
+			want:   map[string]string{"timestamp": "1500000000", "pressure": "1013.250", "rainfall": "1e-1"},
+		},
+		{
+			name:   "json strings are kept and other values ignored",
+			data:   `{"timestamp":"1500000000","temp":"21.5","ok":true,"tags":["a"],"pos":{"x":1},"none":null}`,
+			format: formatJSON,
+			want:   map[string]string{"timestamp": "1500000000", "temp": "21.5"},
+		},
+		{name: "invalid json", data: `{"temp":`, format: formatJSON, invalid: true},
+		{name: "empty json object", data: " {} ", format: formatJSON, want: map[string]string{}},
+		{name: "two ltsv records", data: "temp:21.5\ntemp:22", format: formatLTSV, invalid: true},
+		{name: "empty", data: "", format: formatLTSV, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, fields, err := decodePayload(tt.data)
+			if format != tt.format {
+				t.Errorf("format = %s, want %s", format, tt.format)
+			}
+			if tt.invalid {
+				if err == nil {
+					t.Errorf("decodePayload(%q) = %v, want an error", tt.data, fields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(tt.want) {
+				t.Errorf("decodePayload(%q) = %v, want %v", tt.data, fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDeviceId(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"1e0032000447343138333038", true},
+		{"living", true},
+		{"a/b", true},
+		{"...", true},
+		{strings.Repeat("a", maxDeviceIdLength), true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{strings.Repeat("a", maxDeviceIdLength+1), false},
+		{"living\nroom", false},
+		{"a\x00", false},
+	}
+	for _, tt := range tests {
+		if err := checkDeviceId(tt.id); (err == nil) != tt.valid {
+			t.Errorf("checkDeviceId(%q) = %v, want valid %v", tt.id, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// dedup.go implements suppression of readings that are received more than
+// once, e.g. when the Particle API resends events after a reconnect, a
+// device retries publishing or several sources receive the same data. Each
+// reading gets a deterministic ID derived from its device, timestamp and
+// values, and readings with an ID that was seen within the window are
+// dropped. The ID is added to records so that outputs can deduplicate too.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// readingId returns the ID of a reading. The source and event aren't part of
+// the ID so that the same reading received from different sources has the
+// same ID.
+func readingId(r *Reading) string {
+	h := sha1.New()
+	h.Write([]byte(r.DeviceId))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(r.Timestamp, 10)))
+	for _, m := range metrics.Metrics {
+		val, ok := r.Values[m.Name]
+		if !ok {
+			continue
+		}
+		h.Write([]byte{0})
+		h.Write([]byte(m.Name + "=" + strconv.FormatFloat(val, 'g', -1, 64)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dedupEntry is a reading ID seen by the filter.
+type dedupEntry struct {
+	id   string
+	seen time.Time
+}
+
+// dedupFilter remembers the IDs of readings received within a time window.
+type dedupFilter struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// The IDs seen within the window and the order they were seen in,
+	// oldest first.
+	ids   map[string]bool
+	order []dedupEntry
+}
+
+// The duplicate filter in use. It is nil if duplicates aren't suppressed.
+var dedup *dedupFilter
+
+// newDedupFilter creates a filter that suppresses readings seen again within
+// window.
+func newDedupFilter(window time.Duration) *dedupFilter {
+	return &dedupFilter{
+		window: window,
+		ids:    make(map[string]bool),
+	}
+}
+
+// Check sets the ID of a reading and returns false if the reading is a
+// duplicate of one seen within the window.
+func (f *dedupFilter) Check(r *Reading) bool {
+	r.Id = readingId(r)
+	if f == nil {
+		return true
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Forget the IDs that are older than the window.
+	for len(f.order) > 0 && now.Sub(f.order[0].seen) > f.window {
+		delete(f.ids, f.order[0].id)
+		f.order = f.order[1:]
+	}
+
+	if f.ids[r.Id] {
+		duplicates.Inc(r.Source)
+		return false
+	}
+	f.ids[r.Id] = true
+	f.order = append(f.order, dedupEntry{r.Id, now})
+	return true
+}
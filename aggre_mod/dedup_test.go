@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadingId(t *testing.T) {
+	base := &Reading{Source: "particle", DeviceId: "dev", Event: "weatherdata", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5, "humidity": 40}}
+	tests := []struct {
+		name string
+		r    *Reading
+		same bool
+	}{
+		{"identical", &Reading{Source: "particle", DeviceId: "dev", Event: "weatherdata", Timestamp: 1500000000, Values: map[string]float64{"humidity": 40, "temp": 21.5}}, true},
+		{"other source and event", &Reading{Source: "mqtt", DeviceId: "dev", Event: "climate", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5, "humidity": 40}}, true},
+		{"unknown metric", &Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5, "humidity": 40, "foo": 1}}, true},
+		{"other device", &Reading{DeviceId: "dev2", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5, "humidity": 40}}, false},
+		{"other timestamp", &Reading{DeviceId: "dev", Timestamp: 1500000001, Values: map[string]float64{"temp": 21.5, "humidity": 40}}, false},
+		{"other value", &Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.6, "humidity": 40}}, false},
+		{"missing value", &Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5}}, false},
+		{"value moved to another metric", &Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"temp": 40, "humidity": 21.5}}, false},
+		{"device ID running into timestamp", &Reading{DeviceId: "dev1", Timestamp: 500000000, Values: map[string]float64{"temp": 21.5, "humidity": 40}}, false},
+	}
+	want := readingId(base)
+	if len(want) != 40 {
+		t.Fatalf("readingId() = %q, want 40 hex digits", want)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readingId(tt.r); (got == want) != tt.same {
+				t.Errorf("readingId() = %s, base reading %s, want same: %v", got, want, tt.same)
+			}
+		})
+	}
+}
+
+func TestDedupFilter(t *testing.T) {
+	reading := func(ts int64, temp float64) *Reading {
+		return &Reading{Source: "particle", DeviceId: "dev", Timestamp: ts, Values: map[string]float64{"temp": temp}}
+	}
+	tests := []struct {
+		name   string
+		window time.Duration
+		// The delay before the second reading is checked.
+		wait   time.Duration
+		first  *Reading
+		second *Reading
+		want   bool
+	}{
+		{"duplicate", time.Minute, 0, reading(1, 20), reading(1, 20), false},
+		{"other timestamp", time.Minute, 0, reading(1, 20), reading(2, 20), true},
+		{"other value", time.Minute, 0, reading(1, 20), reading(1, 21), true},
+		{"outside window", 10 * time.Millisecond, 20 * time.Millisecond, reading(1, 20), reading(1, 20), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newDedupFilter(tt.window)
+			if !f.Check(tt.first) {
+				t.Fatal("first reading is a duplicate")
+			}
+			time.Sleep(tt.wait)
+			if got := f.Check(tt.second); got != tt.want {
+				t.Errorf("Check() = %v, want %v", got, tt.want)
+			}
+			if tt.second.Id != readingId(tt.second) {
+				t.Errorf("Id = %q, want %q", tt.second.Id, readingId(tt.second))
+			}
+		})
+	}
+}
+
+func TestDedupFilterNil(t *testing.T) {
+	var f *dedupFilter
+	r := &Reading{DeviceId: "dev", Timestamp: 1, Values: map[string]float64{"temp": 20}}
+	for i := 0; i < 2; i++ {
+		if !f.Check(r) {
+			t.Fatal("a nil filter dropped a reading")
+		}
+	}
+	if r.Id == "" {
+		t.Error("a nil filter didn't set the ID")
+	}
+}
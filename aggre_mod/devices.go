@@ -0,0 +1,347 @@
+// devices.go implements the registry of known devices. The registry holds
+// the latest state of each device and a short history of its most recent
+// readings. It is safe for concurrent use.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeviceInfo is descriptive information about a device that is configured
+// rather than reported by the device.
+type DeviceInfo struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+// loadDeviceInfo reads a JSON file mapping device IDs to device info.
+func loadDeviceInfo(path string) (map[string]DeviceInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := make(map[string]DeviceInfo)
+	if err := json.NewDecoder(f).Decode(&info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Device is the current state of a device.
+type Device struct {
+	Id string
+	DeviceInfo
+	// The latest value of each metric. Metrics that were not in the latest
+	// reading are missing.
+	Values    map[string]float64
+	FirstSeen int64
+	LastSeen  int64
+	Active    bool
+	// ClockSkew is the difference in seconds between the device's clock and
+	// the publish time of its latest reading. It is nil if the publish time
+	// isn't known.
+	ClockSkew   *int64
+	ClockSkewed bool
+}
+
+// MarshalJSON encodes the device with a current_<name> field for each known
+// metric.
+func (d Device) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Record(nil))
+}
+
+// Record returns the device as it is served by the API with the values in
+// the selected units. The units field maps the metrics to their units.
+func (d Device) Record(sel unitSelection) map[string]interface{} {
+	obj := map[string]interface{}{
+		"id":           d.Id,
+		"first_seen":   d.FirstSeen,
+		"last_seen":    d.LastSeen,
+		"active":       d.Active,
+		"clock_skew":   d.ClockSkew,
+		"clock_skewed": d.ClockSkewed,
+	}
+	if d.Name != "" {
+		obj["name"] = d.Name
+	}
+	if d.Location != "" {
+		obj["location"] = d.Location
+	}
+	for _, m := range metrics.Metrics {
+		if val, ok := d.Values[m.Name]; ok {
+			obj["current_"+m.Name] = sel.Value(m, val)
+		} else {
+			obj["current_"+m.Name] = nil
+		}
+	}
+	obj["units"] = sel.Units(metrics.Metrics)
+	return obj
+}
+
+// readingHistory is a ring buffer holding a device's most recent readings.
+type readingHistory struct {
+	readings []*Reading
+	// The index the next reading will be written to.
+	next int
+	// The number of readings in the buffer.
+	count int
+}
+
+func newReadingHistory(size int) *readingHistory {
+	return &readingHistory{readings: make([]*Reading, size)}
+}
+
+// add adds a reading, replacing the oldest one if the buffer is full.
+func (h *readingHistory) add(r *Reading) {
+	if len(h.readings) == 0 {
+		return
+	}
+	h.readings[h.next] = r
+	h.next = (h.next + 1) % len(h.readings)
+	if h.count < len(h.readings) {
+		h.count++
+	}
+}
+
+// list returns the readings in the buffer, oldest first.
+func (h *readingHistory) list() []*Reading {
+	list := make([]*Reading, 0, h.count)
+	if h.count == 0 {
+		return list
+	}
+	start := (h.next - h.count + len(h.readings)) % len(h.readings)
+	for i := 0; i < h.count; i++ {
+		list = append(list, h.readings[(start+i)%len(h.readings)])
+	}
+	return list
+}
+
+// deviceEntry is the registry's record of a single device.
+type deviceEntry struct {
+	device  Device
+	history *readingHistory
+}
+
+// deviceRegistry holds the state of all known devices indexed by device ID.
+type deviceRegistry struct {
+	mu      sync.RWMutex
+	devices map[string]*deviceEntry
+	// Device IDs in the order the devices were first seen.
+	order []string
+
+	timeout     time.Duration
+	historySize int
+	// Configured device info by device ID.
+	info map[string]DeviceInfo
+	// Functions called when a device becomes active or inactive.
+	onActiveChange []func(Device)
+}
+
+// newDeviceRegistry creates a registry. Devices that haven't been seen for
+// longer than timeout are marked inactive and the last historySize readings
+// of each device are kept.
+func newDeviceRegistry(timeout time.Duration, historySize int) *deviceRegistry {
+	return &deviceRegistry{
+		devices:     make(map[string]*deviceEntry),
+		timeout:     timeout,
+		historySize: historySize,
+		info:        make(map[string]DeviceInfo),
+	}
+}
+
+// SetInfo sets the configured info of devices.
+func (reg *deviceRegistry) SetInfo(info map[string]DeviceInfo) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.info = info
+	for id, e := range reg.devices {
+		e.device.DeviceInfo = info[id]
+	}
+}
+
+// OnActiveChange adds a function that is called with the new state of a
+// device when it becomes active or inactive. It must be called before the
+// registry is used.
+func (reg *deviceRegistry) OnActiveChange(f func(Device)) {
+	reg.onActiveChange = append(reg.onActiveChange, f)
+}
+
+// notify calls the active change functions with each of the given devices.
+func (reg *deviceRegistry) notify(changed []Device) {
+	for _, d := range changed {
+		for _, f := range reg.onActiveChange {
+			f(d)
+		}
+	}
+}
+
+// isActive returns true if a device last seen at the given time is active.
+func (reg *deviceRegistry) isActive(lastSeen int64) bool {
+	return time.Now().Unix()-lastSeen < int64(reg.timeout/time.Second)
+}
+
+// Update updates a device with a new reading. Readings older than the
+// device's latest reading only move its FirstSeen time back. Readings must
+// not be modified after they have been added to the registry.
+func (reg *deviceRegistry) Update(r *Reading) {
+	// Notify outside of the lock so that the active change functions can use
+	// the registry.
+	if d, changed := reg.update(r); changed {
+		reg.notify([]Device{d})
+	}
+}
+
+// update updates a device with a new reading and returns its new state and
+// whether its active flag changed.
+func (reg *deviceRegistry) update(r *Reading) (Device, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	e, ok := reg.devices[r.DeviceId]
+	if !ok {
+		// New device
+		e = &deviceEntry{
+			device:  Device{Id: r.DeviceId, DeviceInfo: reg.info[r.DeviceId], FirstSeen: r.Timestamp},
+			history: newReadingHistory(reg.historySize),
+		}
+		reg.devices[r.DeviceId] = e
+		reg.order = append(reg.order, r.DeviceId)
+	}
+
+	if r.Timestamp < e.device.LastSeen {
+		// A reading that arrives late doesn't replace the state of a newer
+		// one. It isn't added to the history either, which is kept in
+		// timestamp order.
+		if r.Timestamp < e.device.FirstSeen {
+			e.device.FirstSeen = r.Timestamp
+		}
+		return e.device, false
+	}
+
+	// The values map is replaced rather than modified so that snapshots
+	// can share it.
+	values := make(map[string]float64)
+	for name, val := range r.Values {
+		values[name] = val
+	}
+
+	active := reg.isActive(r.Timestamp)
+	if e.device.Active && !active {
+		// Log a warning if a device is no longer active.
+		log.Println("Device no longer active:", e.device.Id)
+	}
+
+	changed := e.device.Active != active
+
+	e.device.Values = values
+	e.device.LastSeen = r.Timestamp
+	e.device.Active = active
+	e.device.ClockSkew = nil
+	if skew, ok := r.clockSkew(); ok {
+		e.device.ClockSkew = &skew
+	}
+	e.device.ClockSkewed = r.ClockSkewed
+	e.history.add(r)
+	return e.device, changed
+}
+
+// updateActive re-evaluates the active flag of every device.
+func (reg *deviceRegistry) updateActive() {
+	reg.notify(reg.refreshActive())
+}
+
+// refreshActive re-evaluates the active flag of every device and
+// returns the devices whose flag changed.
+func (reg *deviceRegistry) refreshActive() []Device {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	changed := []Device{}
+	for _, id := range reg.order {
+		d := &reg.devices[id].device
+		active := reg.isActive(d.LastSeen)
+		if d.Active && !active {
+			// Log a warning if a device is no longer active.
+			log.Println("Device no longer active:", d.Id)
+		}
+		if d.Active != active {
+			d.Active = active
+			changed = append(changed, *d)
+		}
+	}
+	return changed
+}
+
+// watch periodically updates the active flag of devices. It never returns.
+func (reg *deviceRegistry) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		reg.updateActive()
+	}
+}
+
+// Snapshot returns a copy of the state of all devices in the order they were
+// first seen.
+func (reg *deviceRegistry) Snapshot() []Device {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	devices := make([]Device, 0, len(reg.order))
+	for _, id := range reg.order {
+		devices = append(devices, reg.devices[id].device)
+	}
+	return devices
+}
+
+// Get returns a copy of the state of a device.
+func (reg *deviceRegistry) Get(id string) (Device, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	e, ok := reg.devices[id]
+	if !ok {
+		return Device{}, false
+	}
+	return e.device, true
+}
+
+// Restore adds devices to the registry, e.g. from a saved snapshot.
+// Devices that are already known are not changed. Restored devices are
+// inactive until their active flag is next updated.
+func (reg *deviceRegistry) Restore(restored []Device) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, d := range restored {
+		if _, ok := reg.devices[d.Id]; ok {
+			continue
+		}
+		d.Active = false
+		d.DeviceInfo = reg.info[d.Id]
+		reg.devices[d.Id] = &deviceEntry{
+			device:  d,
+			history: newReadingHistory(reg.historySize),
+		}
+		reg.order = append(reg.order, d.Id)
+	}
+}
+
+// Recent returns the most recent readings of a device, oldest first.
+func (reg *deviceRegistry) Recent(id string) ([]*Reading, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	e, ok := reg.devices[id]
+	if !ok {
+		return nil, false
+	}
+	return e.history.list(), true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadingHistory(t *testing.T) {
+	tests := []struct {
+		size  int
+		added int
+		want  []int64
+	}{
+		{0, 3, []int64{}},
+		{1, 3, []int64{3}},
+		{3, 0, []int64{}},
+		{3, 2, []int64{1, 2}},
+		{3, 3, []int64{1, 2, 3}},
+		{3, 7, []int64{5, 6, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d of %d", tt.added, tt.size), func(t *testing.T) {
+			h := newReadingHistory(tt.size)
+			for i := 1; i <= tt.added; i++ {
+				h.add(&Reading{Timestamp: int64(i)})
+			}
+			got := []int64{}
+			for _, r := range h.list() {
+				got = append(got, r.Timestamp)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("list() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Readings that arrive out of order don't replace the state of the latest
+// reading.
+func TestDeviceRegistryOutOfOrder(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		times     []int64
+		temp      float64
+		firstSeen int64
+		lastSeen  int64
+		recent    int
+	}{
+		{"in order", []int64{now - 60, now}, 1, now - 60, now, 2},
+		{"late reading", []int64{now, now - 60}, 0, now - 60, now, 1},
+		{"same time", []int64{now, now}, 1, now, now, 2},
+		{"late after several", []int64{now - 60, now, now - 30}, 1, now - 60, now, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newDeviceRegistry(time.Hour, 10)
+			for i, ts := range tt.times {
+				reg.Update(&Reading{DeviceId: "dev", Timestamp: ts, Values: map[string]float64{"temp": float64(i)}})
+			}
+			d, _ := reg.Get("dev")
+			if d.Values["temp"] != tt.temp || d.FirstSeen != tt.firstSeen || d.LastSeen != tt.lastSeen || !d.Active {
+				t.Errorf("device has temp %v, first seen %d, last seen %d and active %v, want %v, %d, %d and true",
+					d.Values["temp"], d.FirstSeen, d.LastSeen, d.Active, tt.temp, tt.firstSeen, tt.lastSeen)
+			}
+			if recent, _ := reg.Recent("dev"); len(recent) != tt.recent {
+				t.Errorf("Recent() returned %d readings, want %d", len(recent), tt.recent)
+			}
+		})
+	}
+}
+
+// Updates from several goroutines are all applied while the registry is
+// read concurrently. Run with -race.
+func TestDeviceRegistryConcurrency(t *testing.T) {
+	const (
+		devicesCount = 4
+		updates      = 200
+		historySize  = 5
+	)
+	reg := newDeviceRegistry(time.Hour, historySize)
+	now := time.Now().Unix()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < devicesCount; i++ {
+		id := fmt.Sprintf("dev%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 1; n <= updates; n++ {
+				reg.Update(&Reading{DeviceId: id, Timestamp: now - updates + int64(n), Values: map[string]float64{"temp": float64(n)}})
+			}
+		}()
+	}
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, d := range reg.Snapshot() {
+				_ = d.Values["temp"]
+				if _, ok := reg.Get(d.Id); !ok {
+					t.Errorf("Get(%q) found no device listed by Snapshot()", d.Id)
+				}
+				if recent, _ := reg.Recent(d.Id); len(recent) > historySize {
+					t.Errorf("Recent(%q) returned %d readings, want at most %d", d.Id, len(recent), historySize)
+				}
+			}
+			reg.updateActive()
+		}
+	}()
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	snapshot := reg.Snapshot()
+	if len(snapshot) != devicesCount {
+		t.Fatalf("Snapshot() has %d devices, want %d", len(snapshot), devicesCount)
+	}
+	for _, d := range snapshot {
+		if d.Values["temp"] != updates || d.LastSeen != now || !d.Active {
+			t.Errorf("device %s has temp %v, last seen %d and active %v, want the last update", d.Id, d.Values["temp"], d.LastSeen, d.Active)
+		}
+		recent, ok := reg.Recent(d.Id)
+		if !ok || len(recent) != historySize {
+			t.Fatalf("Recent(%q) returned %d readings, want %d", d.Id, len(recent), historySize)
+		}
+		for i, r := range recent {
+			if want := float64(updates - historySize + 1 + i); r.Values["temp"] != want {
+				t.Errorf("recent reading %d of %s has temp %v, want %v", i, d.Id, r.Values["temp"], want)
+			}
+		}
+	}
+	if _, ok := reg.Recent("unknown"); ok {
+		t.Error("Recent() found an unknown device")
+	}
+}
@@ -0,0 +1,410 @@
+// export.go implements exporting stored readings or rollups as CSV or NDJSON,
+// both on /api/export and with the export command. Columns are in the order
+// of the fields in the BigQuery schema.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+)
+
+// The statistics exported for each metric of a rollup.
+var rollupColumns = []string{"min", "max", "mean", "count", "first", "last"}
+
+// exportOptions selects the data that is exported.
+type exportOptions struct {
+	// The devices to export. If empty, all devices in the store are
+	// exported.
+	devices []string
+	from    int64
+	to      int64
+	metrics []*Metric
+	// The resolution of the rollups to export. If nil, readings are
+	// exported.
+	resolution *rollupResolution
+	format     string
+	// The units values are converted to.
+	units unitSelection
+}
+
+// Devices returns the IDs of the devices in the store, sorted.
+func (s *readingStore) Devices() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		id, err := url.PathUnescape(f.Name())
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// columns returns the names of the exported columns.
+func (opts *exportOptions) columns() []string {
+	selected := make(map[string]bool)
+	for _, m := range opts.metrics {
+		selected[m.Name] = true
+	}
+
+	columns := []string{}
+	for _, f := range metrics.BigQuerySchema() {
+		switch {
+		case opts.resolution != nil && f.Name == "timestamp":
+			columns = append(columns, "start")
+		case opts.resolution != nil && metrics.Get(f.Name) == nil && f.Name != "deviceid":
+			// Rollups only have the device ID, start and metrics.
+		case metrics.Get(f.Name) == nil:
+			columns = append(columns, f.Name)
+		case !selected[f.Name]:
+		case opts.resolution != nil:
+			for _, stat := range rollupColumns {
+				columns = append(columns, f.Name+"_"+stat)
+			}
+		default:
+			columns = append(columns, f.Name)
+		}
+	}
+	return columns
+}
+
+// exportWriter writes rows in an export format.
+type exportWriter struct {
+	format  string
+	columns []string
+	w       *bufio.Writer
+	csv     *csv.Writer
+}
+
+func newExportWriter(w io.Writer, format string, columns []string) (*exportWriter, error) {
+	ew := &exportWriter{format: format, columns: columns, w: bufio.NewWriter(w)}
+	switch format {
+	case exportFormatCSV:
+		ew.csv = csv.NewWriter(ew.w)
+		if err := ew.csv.Write(columns); err != nil {
+			return nil, err
+		}
+	case exportFormatNDJSON:
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return ew, nil
+}
+
+// Write writes a row. Columns that are missing from row are empty in CSV and
+// left out in NDJSON.
+func (ew *exportWriter) Write(row map[string]interface{}) error {
+	if ew.csv != nil {
+		record := make([]string, len(ew.columns))
+		for i, col := range ew.columns {
+			if val, ok := row[col]; ok {
+				record[i] = formatExportValue(val)
+			}
+		}
+		return ew.csv.Write(record)
+	}
+
+	// Write the object's fields in column order.
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, col := range ew.columns {
+		val, ok := row[col]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(col)
+		v, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+	_, err := ew.w.Write(buf.Bytes())
+	return err
+}
+
+// Flush writes buffered rows.
+func (ew *exportWriter) Flush() error {
+	if ew.csv != nil {
+		ew.csv.Flush()
+		if err := ew.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return ew.w.Flush()
+}
+
+// formatExportValue formats a value as text, e.g. for CSV.
+func formatExportValue(val interface{}) string {
+	switch v := val.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// exportData writes the data selected by opts to w.
+func exportData(w io.Writer, s *readingStore, opts *exportOptions) error {
+	ew, err := newExportWriter(w, opts.format, opts.columns())
+	if err != nil {
+		return err
+	}
+
+	ids := opts.devices
+	if len(ids) == 0 {
+		ids, err = s.Devices()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		if opts.resolution != nil {
+			err = exportRollups(ew, s, id, opts)
+		} else {
+			err = exportReadings(ew, s, id, opts)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ew.Flush()
+}
+
+// exportReadings writes the readings of a device.
+func exportReadings(ew *exportWriter, s *readingStore, id string, opts *exportOptions) error {
+	var after *storeCursor
+	for {
+		readings, next, err := s.Query(id, opts.from, opts.to, after, 1000)
+		if err != nil {
+			return err
+		}
+		for _, r := range readings {
+			row := map[string]interface{}{
+				"deviceid":  r.DeviceId,
+				"timestamp": r.Timestamp,
+			}
+			if r.Id != "" {
+				row["record_id"] = r.Id
+			}
+			if r.Event != "" {
+				row["event"] = r.Event
+			}
+			if r.PublishedAt != 0 {
+				row["published_at"] = r.PublishedAt
+			}
+			if r.DeviceTimestamp != 0 {
+				row["device_timestamp"] = r.DeviceTimestamp
+			}
+			for _, m := range opts.metrics {
+				if val, ok := r.Values[m.Name]; ok {
+					row[m.Name] = opts.units.Value(m, val)
+				}
+			}
+			r.annotateOutliers(row)
+			if err := ew.Write(row); err != nil {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		after = next
+	}
+}
+
+// exportRollups writes the rollups of a device.
+func exportRollups(ew *exportWriter, s *readingStore, id string, opts *exportOptions) error {
+	buckets, err := s.rollups.Query(id, opts.resolution, opts.from, opts.to)
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		row := map[string]interface{}{
+			"deviceid": id,
+			"start":    b.Start,
+		}
+		for _, m := range opts.metrics {
+			stat, ok := b.Stats[m.Name]
+			if !ok {
+				continue
+			}
+			row[m.Name+"_min"] = opts.units.Convert(m, stat.Min)
+			row[m.Name+"_max"] = opts.units.Convert(m, stat.Max)
+			row[m.Name+"_mean"] = opts.units.Convert(m, stat.Sum/float64(stat.Count))
+			row[m.Name+"_count"] = stat.Count
+			row[m.Name+"_first"] = opts.units.Convert(m, stat.First)
+			row[m.Name+"_last"] = opts.units.Convert(m, stat.Last)
+		}
+		if err := ew.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseResolution parses a resolution, which is raw for readings or the
+// name of a rollup resolution.
+func parseResolution(s string) (*rollupResolution, error) {
+	if s == "" || s == "raw" {
+		return nil, nil
+	}
+	res := getRollupResolution(s)
+	if res == nil {
+		return nil, fmt.Errorf("resolution must be raw, 1m, 1h or 1d")
+	}
+	return res, nil
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Exports stored readings or rollups. The devices, from, to, metrics,
+// resolution, format and units query parameters select the data.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		http.Error(w, "The readings store is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	opts := &exportOptions{
+		devices: splitList(q.Get("devices")),
+		format:  stringDefaults(exportFormatCSV, q.Get("format")),
+	}
+	var err error
+	now := time.Now().Unix()
+	if opts.to, err = parseTimeParam(q.Get("to"), now+1); err == nil {
+		opts.from, err = parseTimeParam(q.Get("from"), opts.to-24*60*60)
+	}
+	if err == nil {
+		opts.metrics, err = parseMetricsParam(q.Get("metrics"))
+	}
+	if err == nil {
+		opts.resolution, err = parseResolution(q.Get("resolution"))
+	}
+	if err == nil {
+		opts.units, err = parseUnitsParam(q.Get("units"))
+	}
+	if err == nil && opts.format != exportFormatCSV && opts.format != exportFormatNDJSON {
+		err = fmt.Errorf("format must be csv or ndjson")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if opts.format == exportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=aggre_mod-export.%s", opts.format))
+	if err := exportData(w, store, opts); err != nil {
+		// The response has most likely been started so the error can only
+		// be logged.
+		log.Printf("Could not export data: %v", err)
+	}
+}
+
+// exportCommand runs the export command with the given arguments.
+func exportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	devices := fs.String("devices", "", "A comma separated list of device IDs to export. If empty, all devices are exported.")
+	from := fs.String("from", "", "Export data from this time (RFC 3339 or seconds since the epoch). Defaults to one day before -to.")
+	to := fs.String("to", "", "Export data before this time (RFC 3339 or seconds since the epoch). Defaults to now.")
+	metricNames := fs.String("metrics", "", "A comma separated list of metrics to export. If empty, all metrics are exported.")
+	resolution := fs.String("resolution", "raw", "Export readings (raw) or rollups (1m, 1h or 1d).")
+	format := fs.String("format", exportFormatCSV, "The output format: csv or ndjson.")
+	units := fs.String("units", "", "The units to convert values to: metric, imperial and/or metric:unit pairs, e.g. imperial,pressure:hPa. If empty, values are in the units of their metrics.")
+	output := fs.String("o", "", "The file to write to. If empty, data is written to stdout.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -store-dir=DIR [flags] export [export flags]\n\nExport flags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *storeDir == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	s := openReadingStore()
+
+	opts := &exportOptions{
+		devices: splitList(*devices),
+		format:  *format,
+	}
+	var err error
+	if opts.to, err = parseTimeParam(*to, time.Now().Unix()+1); err != nil {
+		log.Fatal("Invalid value for -to: ", err)
+	}
+	if opts.from, err = parseTimeParam(*from, opts.to-24*60*60); err != nil {
+		log.Fatal("Invalid value for -from: ", err)
+	}
+	if opts.metrics, err = parseMetricsParam(*metricNames); err != nil {
+		log.Fatal("Invalid value for -metrics: ", err)
+	}
+	if opts.resolution, err = parseResolution(*resolution); err != nil {
+		log.Fatal("Invalid value for -resolution: ", err)
+	}
+	if opts.units, err = parseUnitsParam(*units); err != nil {
+		log.Fatal("Invalid value for -units: ", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal("Could not create output file: ", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := exportData(w, s, opts); err != nil {
+		log.Fatal("Could not export data: ", err)
+	}
+}
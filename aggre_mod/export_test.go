@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExportColumns(t *testing.T) {
+	tests := []struct {
+		name       string
+		metrics    []string
+		resolution string
+		want       []string
+	}{
+		{
+			name:    "readings",
+			metrics: []string{"humidity", "temp"},
+			want:    []string{"deviceid", "record_id", "temp", "humidity", "timestamp", "published_at", "device_timestamp", "event", "quality", "outliers"},
+		},
+		{
+			name:       "rollups",
+			metrics:    []string{"pressure", "temp"},
+			resolution: "1h",
+			want: []string{"deviceid",
+				"temp_min", "temp_max", "temp_mean", "temp_count", "temp_first", "temp_last",
+				"pressure_min", "pressure_max", "pressure_mean", "pressure_count", "pressure_first", "pressure_last",
+				"start"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &exportOptions{}
+			for _, name := range tt.metrics {
+				opts.metrics = append(opts.metrics, metrics.Get(name))
+			}
+			var err error
+			if opts.resolution, err = parseResolution(tt.resolution); err != nil {
+				t.Fatal(err)
+			}
+			if got := opts.columns(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("columns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportData(t *testing.T) {
+	const day = 1792195200
+	s, err := openStore(tempDir(t), 0, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Reading{
+		{DeviceId: "b", Timestamp: day + 60, Values: map[string]float64{"temp": 20, "humidity": 40}},
+		{DeviceId: "a", Timestamp: day, Event: "weatherdata", Values: map[string]float64{"temp": 21.5}},
+		{DeviceId: "a", Timestamp: day + 120, Values: map[string]float64{"temp": 22, "humidity": 41.25}},
+	} {
+		if err := s.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	temp, humidity := metrics.Get("temp"), metrics.Get("humidity")
+
+	tests := []struct {
+		name string
+		opts exportOptions
+		want string
+	}{
+		{
+			name: "csv",
+			opts: exportOptions{from: day, to: day + 3600, metrics: []*Metric{temp, humidity}, format: exportFormatCSV},
+			want: "deviceid,record_id,temp,humidity,timestamp,published_at,device_timestamp,event,quality,outliers\n" +
+				"a,,21.5,,1792195200,,,weatherdata,,\n" +
+				"a,,22,41.25,1792195320,,,,,\n" +
+				"b,,20,40,1792195260,,,,,\n",
+		},
+		{
+			name: "ndjson",
+			opts: exportOptions{devices: []string{"b"}, from: day, to: day + 3600, metrics: []*Metric{humidity}, format: exportFormatNDJSON},
+			want: `{"deviceid":"b","humidity":40,"timestamp":1792195260}` + "\n",
+		},
+		{
+			name: "time range",
+			opts: exportOptions{devices: []string{"a"}, from: day + 1, to: day + 3600, metrics: []*Metric{temp}, format: exportFormatCSV},
+			want: "deviceid,record_id,temp,timestamp,published_at,device_timestamp,event,quality,outliers\n" +
+				"a,,22,1792195320,,,,,\n",
+		},
+		{
+			name: "converted",
+			opts: exportOptions{devices: []string{"a"}, from: day, to: day + 3600, metrics: []*Metric{temp}, format: exportFormatNDJSON, units: unitSelection{"temp": "fahrenheit"}},
+			want: `{"deviceid":"a","temp":70.7,"timestamp":1792195200,"event":"weatherdata"}` + "\n" +
+				`{"deviceid":"a","temp":71.6,"timestamp":1792195320}` + "\n",
+		},
+		{
+			name: "rollups",
+			opts: exportOptions{devices: []string{"a"}, from: day, to: day + 3600, metrics: []*Metric{temp}, resolution: getRollupResolution("1h"), format: exportFormatCSV},
+			want: "deviceid,temp_min,temp_max,temp_mean,temp_count,temp_first,temp_last,start\n" +
+				"a,21.5,22,21.75,2,21.5,22,1792195200\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := exportData(&buf, s, &tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("exported\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// fluentd.go implements sending records to Fluentd. Records that can't be
+// delivered are written to an optional spool and sent again, in order, once
+// Fluentd is reachable. Records can be sent with a chunk ID that Fluentd
+// acknowledges so that a record only counts as delivered once Fluentd
+// received it, not when it was written to the connection.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fluent/fluent-logger-golang/fluent"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// The tags that readings and quarantined readings are posted with.
+const (
+	fluentdTag           = "aggre_mod.sensordata"
+	fluentdQuarantineTag = "aggre_mod.quarantine"
+)
+
+// fluentdWriter writes encoded messages to Fluentd using the forward
+// protocol. Unlike fluent.Fluent it reports write errors to the caller and
+// reconnects on the next write instead of in the background, so it never
+// panics when Fluentd is unreachable for a long time.
+type fluentdWriter struct {
+	addr    string
+	timeout time.Duration
+	// requireAck makes the writer wait for Fluentd to acknowledge messages
+	// that have a chunk ID.
+	requireAck bool
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newFluentdWriter(host string, port int, requireAck bool) *fluentdWriter {
+	return &fluentdWriter{
+		addr:       net.JoinHostPort(host, fmt.Sprintf("%d", port)),
+		timeout:    3 * time.Second,
+		requireAck: requireAck,
+	}
+}
+
+// Connect connects to Fluentd if not already connected.
+func (w *fluentdWriter) Connect() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.connect()
+}
+
+// connect connects to Fluentd if not already connected. w.mu must be held.
+func (w *fluentdWriter) connect() error {
+	if w.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", w.addr, w.timeout)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write writes an encoded message to Fluentd. If the writer requires acks
+// and the message has a chunk ID, it waits for Fluentd to acknowledge it.
+func (w *fluentdWriter) Write(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.connect(); err != nil {
+		return err
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	_, err := w.conn.Write(data)
+	if err == nil && w.requireAck {
+		if chunk := fluentdMessageChunk(data); chunk != "" {
+			err = w.readAck(chunk)
+		}
+	}
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+// readAck reads Fluentd's response to a message and checks that it
+// acknowledges the given chunk. w.mu must be held.
+func (w *fluentdWriter) readAck(chunk string) error {
+	w.conn.SetReadDeadline(time.Now().Add(w.timeout))
+	// The response is read as bytes because the strings msgp.Reader returns
+	// point into memory that may be reused.
+	r := msgp.NewReader(w.conn)
+	n, err := r.ReadMapHeader()
+	var ack []byte
+	for i := uint32(0); i < n && err == nil; i++ {
+		var key []byte
+		if key, err = r.ReadMapKey(nil); err != nil {
+			break
+		}
+		if string(key) == "ack" {
+			ack, err = r.ReadStringAsBytes(nil)
+		} else {
+			err = r.Skip()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("no ack from Fluentd: %v", err)
+	}
+	if string(ack) != chunk {
+		return fmt.Errorf("Fluentd acknowledged chunk %q instead of %q", ack, chunk)
+	}
+	return nil
+}
+
+// Connected returns true if the last attempt to connect or write succeeded.
+func (w *fluentdWriter) Connected() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn != nil
+}
+
+// Close closes the connection.
+func (w *fluentdWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// fluentdSink is a Sink that posts readings to Fluentd.
+type fluentdSink struct {
+	writer *fluentdWriter
+	tag    string
+	// spool holds records that could not be delivered. It is nil if
+	// spooling is disabled.
+	spool     *spool
+	retryWait time.Duration
+}
+
+// newFluentdSink creates a sink that posts to the given writer with the
+// given tag. If spool is not nil, undeliverable records are written to it and
+// sent again once Fluentd is reachable.
+func newFluentdSink(writer *fluentdWriter, tag string, spool *spool, retryWait time.Duration) *fluentdSink {
+	s := &fluentdSink{
+		writer:    writer,
+		tag:       tag,
+		spool:     spool,
+		retryWait: retryWait,
+	}
+	if spool != nil {
+		go s.drain()
+	}
+	return s
+}
+
+// encodeFluentdMessage encodes a record as a Fluentd forward protocol
+// message. If ack is true, the message gets a random chunk ID that Fluentd
+// acknowledges.
+func encodeFluentdMessage(tag string, t time.Time, record map[string]interface{}, ack bool) ([]byte, error) {
+	msg := &fluent.Message{Tag: tag, Time: t.Unix(), Record: record}
+	if ack {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		msg.Option = map[string]interface{}{"chunk": base64.StdEncoding.EncodeToString(id)}
+	}
+	return msg.MarshalMsg(nil)
+}
+
+// fluentdMessageChunk returns the chunk ID of an encoded message or an empty
+// string if it doesn't have one.
+func fluentdMessageChunk(data []byte) string {
+	var msg fluent.Message
+	if _, err := msg.UnmarshalMsg(data); err != nil {
+		return ""
+	}
+	option, _ := msg.Option.(map[string]interface{})
+	chunk, _ := option["chunk"].(string)
+	return chunk
+}
+
+func (s *fluentdSink) Name() string {
+	return "fluentd"
+}
+
+// Write sends a reading to Fluentd. If Fluentd can't be reached and spooling
+// is enabled the record is spooled instead and no error is returned.
+func (s *fluentdSink) Write(r *Reading) error {
+	now := time.Now()
+	data, err := encodeFluentdMessage(s.tag, now, r.Record(), s.writer.requireAck)
+	if err != nil {
+		return err
+	}
+
+	// Keep records in order by spooling while there are older records
+	// waiting to be sent.
+	if s.spool != nil && s.spool.Len() > 0 {
+		return s.spool.Append(now, data)
+	}
+
+	err = s.writer.Write(data)
+	if err != nil && s.spool != nil {
+		log.Printf("Could not send data from %s to Fluentd, spooling: %v", r.DeviceId, err)
+		return s.spool.Append(now, data)
+	}
+	return err
+}
+
+// drain sends spooled records to Fluentd in order. It never returns.
+func (s *fluentdSink) drain() {
+	backoff := s.retryWait
+	for {
+		e, ok, err := s.spool.Peek()
+		if err != nil {
+			log.Printf("Could not read from spool: %v", err)
+		}
+		if !ok || err != nil {
+			time.Sleep(s.retryWait)
+			continue
+		}
+
+		if err := s.writer.Write(e.Data); err != nil {
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = s.retryWait
+
+		if err := s.spool.Remove(e); err != nil {
+			log.Printf("Could not remove record from spool: %v", err)
+		}
+		if s.spool.Len() == 0 {
+			log.Printf("Spooled records sent to Fluentd.")
+		}
+	}
+}
+
+// Flush does nothing as records are sent to Fluentd as they are written.
+func (s *fluentdSink) Flush() error {
+	return nil
+}
+
+// Close closes the connection to Fluentd.
+func (s *fluentdSink) Close() error {
+	return s.writer.Close()
+}
+
+// Health returns an error if Fluentd is unreachable. Fluentd being
+// unreachable is not an error if records are spooled.
+func (s *fluentdSink) Health() error {
+	if !s.writer.Connected() && s.spool == nil {
+		return errors.New("Not connected.")
+	}
+	return nil
+}
+
+// Status returns a description of the state of the spool for the health
+// endpoint.
+func (s *fluentdSink) Status() string {
+	if s.spool == nil {
+		return ""
+	}
+	n := s.spool.Len()
+	if n == 0 {
+		return "fluentd spool: 0 records."
+	}
+	return fmt.Sprintf("fluentd spool: %d records, oldest %s old.", n, time.Since(s.spool.Oldest()).Truncate(time.Second))
+}
@@ -0,0 +1,157 @@
+// gcpauth.go implements authenticating to Google Cloud APIs with a service
+// account JSON key using the OAuth 2.0 JWT bearer flow.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// serviceAccountKey holds the fields of a service account JSON key that are
+// needed to get access tokens.
+type serviceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// googleTokenSource gets and caches access tokens for a service account.
+type googleTokenSource struct {
+	email    string
+	keyId    string
+	key      *rsa.PrivateKey
+	tokenURL string
+	scope    string
+	client   *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// loadGoogleTokenSource reads a service account JSON key and returns a token
+// source for the given scope.
+func loadGoogleTokenSource(path, scope string) (*googleTokenSource, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k serviceAccountKey
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	if k.ClientEmail == "" || k.PrivateKey == "" {
+		return nil, fmt.Errorf("%s is not a service account key", path)
+	}
+
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s has no PEM encoded private key", path)
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("the private key in %s is not an RSA key", path)
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("could not parse the private key in %s: %v", path, err)
+	}
+
+	return &googleTokenSource{
+		email:    k.ClientEmail,
+		keyId:    k.PrivateKeyId,
+		key:      key,
+		tokenURL: stringDefaults(googleTokenURL, k.TokenURI),
+		scope:    scope,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Token returns a valid access token, getting a new one if the cached token
+// is about to expire.
+func (ts *googleTokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	assertion, err := ts.assertion(time.Now())
+	if err != nil {
+		return "", err
+	}
+	resp, err := ts.client.PostForm(ts.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("could not get access token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("could not parse access token: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token returned")
+	}
+	ts.token = token.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// assertion returns a signed JWT requesting an access token.
+func (ts *googleTokenSource) assertion(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": ts.keyId})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   ts.email,
+		"scope": ts.scope,
+		"aud":   ts.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ts.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,174 @@
+// hadiscovery.go implements Home Assistant MQTT discovery for the mqtt
+// output. A sensor config is published for each metric of each known device
+// so that Home Assistant adds the sensors without configuring them by hand.
+// Configs are published again whenever Home Assistant comes online.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+)
+
+// The payload Home Assistant publishes to <prefix>/status when it starts.
+const haPayloadOnline = "online"
+
+// haUnits maps metric units to the units Home Assistant expects. Other units
+// are used as is.
+var haUnits = map[string]string{
+	"celsius":    "°C",
+	"fahrenheit": "°F",
+	"percent":    "%",
+	"degrees":    "°",
+}
+
+// haInvalidId matches the characters that aren't allowed in the node and
+// object IDs of discovery topics.
+var haInvalidId = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// haId returns s with characters that aren't allowed in IDs replaced.
+func haId(s string) string {
+	return haInvalidId.ReplaceAllString(s, "_")
+}
+
+// haDevice is the device that a Home Assistant sensor belongs to.
+type haDevice struct {
+	Identifiers   []string `json:"identifiers"`
+	Name          string   `json:"name"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+	Model         string   `json:"model"`
+}
+
+// haAvailability is a topic that the availability of a Home Assistant sensor
+// is read from.
+type haAvailability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+// haSensorConfig is the discovery config of a Home Assistant sensor.
+type haSensorConfig struct {
+	Name          string `json:"name"`
+	UniqueId      string `json:"unique_id"`
+	StateTopic    string `json:"state_topic"`
+	ValueTemplate string `json:"value_template,omitempty"`
+	Unit          string `json:"unit_of_measurement,omitempty"`
+	DeviceClass   string `json:"device_class,omitempty"`
+	StateClass    string `json:"state_class"`
+	// A sensor is available if both its device and the mqtt output are.
+	Availability     []haAvailability `json:"availability,omitempty"`
+	AvailabilityMode string           `json:"availability_mode,omitempty"`
+	Device           haDevice         `json:"device"`
+}
+
+// discoveryTopic returns the topic of the config of a device's sensor for
+// the given metric.
+func (s *mqttPublisher) discoveryTopic(device, metric string) string {
+	return s.config.DiscoveryPrefix + "/sensor/" + haId(device) + "/" + haId(metric) + "/config"
+}
+
+// statusTopic returns the topic Home Assistant publishes its status to.
+func (s *mqttPublisher) statusTopic() string {
+	return s.config.DiscoveryPrefix + "/status"
+}
+
+// sensorConfig returns the discovery config of a device's sensor for a
+// metric.
+func (s *mqttPublisher) sensorConfig(d Device, m *Metric) haSensorConfig {
+	c := haSensorConfig{
+		Name:        m.Name,
+		UniqueId:    "aggre_mod_" + haId(d.Id) + "_" + haId(m.Name),
+		StateTopic:  s.topic(s.config.Topic, d.Id, m.Name),
+		Unit:        stringDefaults(m.Unit, haUnits[m.Unit]),
+		DeviceClass: m.DeviceClass,
+		StateClass:  "measurement",
+		Device: haDevice{
+			Identifiers:   []string{"aggre_mod_" + haId(d.Id)},
+			Name:          stringDefaults(d.Id, d.Name),
+			SuggestedArea: d.Location,
+			Model:         "aggre_mod",
+		},
+	}
+	if !s.publishesMetrics() {
+		c.ValueTemplate = "{{ value_json." + m.Name + " }}"
+	}
+	if s.config.AvailabilityTopic != "" {
+		for _, topic := range []string{s.topic(s.config.AvailabilityTopic, d.Id, ""), s.outputAvailabilityTopic()} {
+			c.Availability = append(c.Availability, haAvailability{topic, mqttPayloadOnline, mqttPayloadOffline})
+		}
+		c.AvailabilityMode = "all"
+	}
+	return c
+}
+
+// discover publishes the configs of a device's sensors for the given values
+// unless they have already been published on the current connection.
+func (s *mqttPublisher) discover(client *mqttClient, d Device, values map[string]float64) error {
+	if s.config.DiscoveryPrefix == "" {
+		return nil
+	}
+
+	for _, m := range metrics.Metrics {
+		if _, ok := values[m.Name]; !ok {
+			continue
+		}
+		key := labelKey([]string{d.Id, m.Name})
+		s.mu.Lock()
+		discovered := s.discovered[key]
+		s.discovered[key] = true
+		s.mu.Unlock()
+		if discovered {
+			continue
+		}
+
+		b, err := json.Marshal(s.sensorConfig(d, m))
+		if err == nil {
+			err = client.Publish(mqttMessage{
+				Topic:   s.discoveryTopic(d.Id, m.Name),
+				Payload: b,
+				Qos:     s.config.Qos,
+				Retain:  true,
+			})
+		}
+		if err != nil {
+			s.mu.Lock()
+			delete(s.discovered, key)
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// discoverAll publishes the configs of the sensors of every device in the
+// registry.
+func (s *mqttPublisher) discoverAll(client *mqttClient) {
+	if s.config.DiscoveryPrefix == "" || devices == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.discovered = make(map[string]bool)
+	s.mu.Unlock()
+
+	for _, d := range devices.Snapshot() {
+		if err := s.discover(client, d, d.Values); err != nil {
+			log.Printf("Could not publish Home Assistant discovery config of %s: %v", d.Id, err)
+			return
+		}
+	}
+}
+
+// discoverDevice publishes the configs of the sensors for the values of a
+// reading if the device or any of the metrics are new.
+func (s *mqttPublisher) discoverDevice(client *mqttClient, r *Reading) error {
+	d := Device{Id: r.DeviceId}
+	if devices != nil {
+		if known, ok := devices.Get(r.DeviceId); ok {
+			d = known
+		}
+	}
+	return s.discover(client, d, r.Values)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSensorConfig(t *testing.T) {
+	d := Device{Id: "abc.123", DeviceInfo: DeviceInfo{Name: "Garden", Location: "Outside"}}
+	tests := []struct {
+		name   string
+		config mqttPublisherConfig
+		device Device
+		metric string
+		want   string
+	}{
+		{
+			name:   "topic per metric",
+			config: mqttPublisherConfig{Topic: "weathersensors/{device}/{metric}"},
+			device: d,
+			metric: "temp",
+			want: `{"name":"temp","unique_id":"aggre_mod_abc_123_temp","state_topic":"weathersensors/abc.123/temp",` +
+				`"unit_of_measurement":"°C","device_class":"temperature","state_class":"measurement",` +
+				`"device":{"identifiers":["aggre_mod_abc_123"],"name":"Garden","suggested_area":"Outside","model":"aggre_mod"}}`,
+		},
+		{
+			name:   "topic per device",
+			config: mqttPublisherConfig{Topic: "weathersensors/{device}"},
+			device: Device{Id: "abc"},
+			metric: "humidity",
+			want: `{"name":"humidity","unique_id":"aggre_mod_abc_humidity","state_topic":"weathersensors/abc",` +
+				`"value_template":"{{ value_json.humidity }}","unit_of_measurement":"%","device_class":"humidity","state_class":"measurement",` +
+				`"device":{"identifiers":["aggre_mod_abc"],"name":"abc","model":"aggre_mod"}}`,
+		},
+		{
+			name:   "availability",
+			config: mqttPublisherConfig{Topic: "weathersensors/{device}/{metric}", AvailabilityTopic: "weathersensors/{device}/availability"},
+			device: Device{Id: "abc"},
+			metric: "pressure",
+			want: `{"name":"pressure","unique_id":"aggre_mod_abc_pressure","state_topic":"weathersensors/abc/pressure",` +
+				`"unit_of_measurement":"hPa","device_class":"atmospheric_pressure","state_class":"measurement",` +
+				`"availability":[{"topic":"weathersensors/abc/availability","payload_available":"online","payload_not_available":"offline"},` +
+				`{"topic":"weathersensors/aggre_mod-publisher/availability","payload_available":"online","payload_not_available":"offline"}],` +
+				`"availability_mode":"all",` +
+				`"device":{"identifiers":["aggre_mod_abc"],"name":"abc","model":"aggre_mod"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.DiscoveryPrefix = "homeassistant"
+			s := newMQTTPublisher(mqttConfig{ClientId: "aggre_mod-publisher"}, tt.config)
+			b, err := json.Marshal(s.sensorConfig(tt.device, metrics.Get(tt.metric)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("sensorConfig() =\n%s\nwant\n%s", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoveryTopic(t *testing.T) {
+	s := newMQTTPublisher(mqttConfig{}, mqttPublisherConfig{DiscoveryPrefix: "homeassistant"})
+	if got, want := s.discoveryTopic("abc.123", "PM2.5"), "homeassistant/sensor/abc_123/PM2_5/config"; got != want {
+		t.Errorf("discoveryTopic() = %s, want %s", got, want)
+	}
+	if got, want := s.statusTopic(), "homeassistant/status"; got != want {
+		t.Errorf("statusTopic() = %s, want %s", got, want)
+	}
+}
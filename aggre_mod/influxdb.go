@@ -0,0 +1,311 @@
+// influxdb.go implements a Sink that writes readings to InfluxDB using the
+// line protocol over the HTTP write API. Both the InfluxDB 1.x /write and the
+// 2.x /api/v2/write endpoints are supported.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxDBConfig configures an InfluxDB sink.
+type influxDBConfig struct {
+	// URL is the base URL of the InfluxDB server, e.g. http://localhost:8086.
+	URL string
+	// Database is the database written to with the 1.x API.
+	Database string
+	Username string
+	Password string
+	// Org and Bucket are written to with the 2.x API. If Bucket is set the
+	// 2.x API is used.
+	Org    string
+	Bucket string
+	Token  string
+
+	Measurement string
+	// Precision of the point times: ns, us, ms or s.
+	Precision string
+	// The number of points sent in a single request.
+	BatchSize int
+	Gzip      bool
+	// The number of times a failed request is retried.
+	Retries   int
+	RetryWait time.Duration
+}
+
+// influxDBPrecisions maps precisions to the multiplier applied to timestamps
+// in seconds and the name used by the 1.x API.
+var influxDBPrecisions = map[string]struct {
+	multiplier int64
+	v1         string
+}{
+	"ns": {int64(time.Second / time.Nanosecond), "n"},
+	"us": {int64(time.Second / time.Microsecond), "u"},
+	"ms": {int64(time.Second / time.Millisecond), "ms"},
+	"s":  {1, "s"},
+}
+
+// influxDBSink batches readings as line protocol points and writes them to
+// InfluxDB.
+type influxDBSink struct {
+	config     influxDBConfig
+	writeURL   string
+	multiplier int64
+	client     *http.Client
+
+	// sendMu is held while a batch is sent so that batches are sent one
+	// at a time and in order.
+	sendMu sync.Mutex
+
+	// mu protects the fields below. It isn't held while a batch is sent so
+	// that Health doesn't wait for retries.
+	mu     sync.Mutex
+	batch  bytes.Buffer
+	points int
+	// The error returned by the last write, if any.
+	lastErr error
+}
+
+// newInfluxDBSink creates a sink that writes to the InfluxDB server
+// described by config.
+func newInfluxDBSink(config influxDBConfig) (*influxDBSink, error) {
+	precision, ok := influxDBPrecisions[config.Precision]
+	if !ok {
+		return nil, fmt.Errorf("unknown precision %q", config.Precision)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+
+	u, err := url.Parse(strings.TrimRight(config.URL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	if config.Bucket != "" {
+		u.Path += "/api/v2/write"
+		q.Set("org", config.Org)
+		q.Set("bucket", config.Bucket)
+		q.Set("precision", config.Precision)
+	} else {
+		if config.Database == "" {
+			return nil, errors.New("a database or bucket is required")
+		}
+		u.Path += "/write"
+		q.Set("db", config.Database)
+		q.Set("precision", precision.v1)
+		if config.Username != "" {
+			q.Set("u", config.Username)
+			q.Set("p", config.Password)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	return &influxDBSink{
+		config:     config,
+		writeURL:   u.String(),
+		multiplier: precision.multiplier,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *influxDBSink) Name() string {
+	return "influxdb"
+}
+
+// Write adds a reading to the current batch and sends the batch if it is
+// full.
+func (s *influxDBSink) Write(r *Reading) error {
+	line := s.point(r)
+	if line == "" {
+		// A point must have at least one field.
+		return nil
+	}
+
+	s.mu.Lock()
+	s.batch.WriteString(line)
+	s.batch.WriteByte('\n')
+	s.points++
+	full := s.points >= s.config.BatchSize
+	s.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+	return s.Flush()
+}
+
+// Flush sends the current batch, retrying failed requests. The batch is
+// dropped if it can't be sent.
+func (s *influxDBSink) Flush() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	points := s.points
+	body := append([]byte(nil), s.batch.Bytes()...)
+	s.batch.Reset()
+	s.points = 0
+	s.mu.Unlock()
+
+	if points == 0 {
+		return nil
+	}
+	err := s.send(body)
+	if err != nil {
+		err = fmt.Errorf("dropped %d points: %v", points, err)
+	}
+
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+	return err
+}
+
+// send sends a batch of points, retrying failed requests.
+func (s *influxDBSink) send(body []byte) error {
+	if s.config.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	backoff := s.config.RetryWait
+	var err error
+	for i := 0; i <= s.config.Retries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		retry, err = s.post(body)
+		if err == nil || !retry {
+			break
+		}
+	}
+	return err
+}
+
+// post sends a request to the write endpoint. retry is true if the request
+// failed and may succeed if retried.
+func (s *influxDBSink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.config.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("InfluxDB returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	// Retry server errors and rate limiting. Other client errors, e.g. a
+	// malformed point, fail again if retried.
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Close sends the current batch.
+func (s *influxDBSink) Close() error {
+	return s.Flush()
+}
+
+// Health returns the error of the last write.
+func (s *influxDBSink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+// point returns a reading as a line protocol point. The device ID, source
+// and event, the device's configured name and location and the quality of
+// readings with outliers are tags and the metrics are fields. An empty
+// string is returned if the reading has no values.
+func (s *influxDBSink) point(r *Reading) string {
+	fields := []string{}
+	for _, m := range metrics.Metrics {
+		val, ok := r.Values[m.Name]
+		if !ok {
+			continue
+		}
+		var v string
+		if m.Type == metricTypeInteger {
+			v = strconv.FormatInt(int64(val), 10) + "i"
+		} else {
+			v = strconv.FormatFloat(val, 'f', -1, 64)
+		}
+		fields = append(fields, influxDBEscape(m.Name, ",= ")+"="+v)
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// Tags are sorted by key as recommended for performance.
+	tags := influxDBEscape(s.config.Measurement, ", ")
+	tags += ",deviceid=" + influxDBEscape(r.DeviceId, ",= ")
+	if r.Event != "" {
+		tags += ",event=" + influxDBEscape(r.Event, ",= ")
+	}
+	var info DeviceInfo
+	if devices != nil {
+		if d, ok := devices.Get(r.DeviceId); ok {
+			info = d.DeviceInfo
+		}
+	}
+	if info.Location != "" {
+		tags += ",location=" + influxDBEscape(info.Location, ",= ")
+	}
+	if info.Name != "" {
+		tags += ",name=" + influxDBEscape(info.Name, ",= ")
+	}
+	if len(r.Outliers) > 0 {
+		tags += ",quality=" + qualityOutlier
+	}
+	if r.Source != "" {
+		tags += ",source=" + influxDBEscape(r.Source, ",= ")
+	}
+
+	return tags + " " + strings.Join(fields, ",") + " " + strconv.FormatInt(r.Timestamp*s.multiplier, 10)
+}
+
+// influxDBEscape escapes the given characters with a backslash. Line
+// breaks can't be escaped and are replaced with spaces, which must be among
+// the escaped characters.
+func influxDBEscape(s, chars string) string {
+	var b bytes.Buffer
+	for _, c := range s {
+		if c == '\n' || c == '\r' {
+			c = ' '
+		}
+		if strings.ContainsRune(chars, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
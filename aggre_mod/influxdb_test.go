@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxDBEscape(t *testing.T) {
+	tests := []struct {
+		s, chars string
+		want     string
+	}{
+		{"sensordata", ", ", "sensordata"},
+		{"sensor data,v2", ", ", `sensor\ data\,v2`},
+		{"a=b", ", ", "a=b"},
+		{"a=b", ",= ", `a\=b`},
+		{"living room, 1st floor", ",= ", `living\ room\,\ 1st\ floor`},
+		{"", ",= ", ""},
+		{"Küche", ",= ", "Küche"},
+		{"living\nroom\r\n", ",= ", `living\ room\ \ `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := influxDBEscape(tt.s, tt.chars); got != tt.want {
+				t.Errorf("influxDBEscape(%q, %q) = %s, want %s", tt.s, tt.chars, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfluxDBPoint(t *testing.T) {
+	oldDevices := devices
+	defer func() { devices = oldDevices }()
+	devices = newDeviceRegistry(time.Hour, 0)
+	devices.SetInfo(map[string]DeviceInfo{"dev 1": {Name: "Living Room", Location: "House, ground floor"}})
+	devices.Update(&Reading{DeviceId: "dev 1", Timestamp: 1500000000, Values: map[string]float64{"temp": 20}})
+
+	tests := []struct {
+		name        string
+		measurement string
+		precision   string
+		r           *Reading
+		want        string
+	}{
+		{
+			name:        "tags and fields",
+			measurement: "sensordata",
+			precision:   "s",
+			r:           &Reading{Source: "particle", DeviceId: "dev", Event: "weatherdata", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5, "humidity": 40}},
+			want:        "sensordata,deviceid=dev,event=weatherdata,source=particle temp=21.5,humidity=40 1500000000",
+		},
+		{
+			name:        "escaped measurement and tags",
+			measurement: "sensor data",
+			precision:   "s",
+			r:           &Reading{Source: "mqtt", DeviceId: "a,b=c d", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5}},
+			want:        `sensor\ data,deviceid=a\,b\=c\ d,source=mqtt temp=21.5 1500000000`,
+		},
+		{
+			name:        "device info",
+			measurement: "sensordata",
+			precision:   "s",
+			r:           &Reading{Source: "mqtt", DeviceId: "dev 1", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5}},
+			want:        `sensordata,deviceid=dev\ 1,location=House\,\ ground\ floor,name=Living\ Room,source=mqtt temp=21.5 1500000000`,
+		},
+		{
+			name:        "line breaks in tags",
+			measurement: "sensordata",
+			precision:   "s",
+			r:           &Reading{DeviceId: "dev\n2", Event: "weather\r\ndata", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5}},
+			want:        `sensordata,deviceid=dev\ 2,event=weather\ \ data temp=21.5 1500000000`,
+		},
+		{
+			name:        "outlier",
+			measurement: "sensordata",
+			precision:   "s",
+			r:           &Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"temp": 40}, Outliers: map[string]string{"temp": outlierRuleRate}},
+			want:        "sensordata,deviceid=dev,quality=outlier temp=40 1500000000",
+		},
+		{
+			name:        "integer metric",
+			measurement: "sensordata",
+			precision:   "ms",
+			r:           &Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"foo": 3}},
+			want:        "sensordata,deviceid=dev foo=3i 1500000000000",
+		},
+		{
+			name:        "no values",
+			measurement: "sensordata",
+			precision:   "s",
+			r:           &Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{}},
+			want:        "",
+		},
+	}
+
+	oldMetrics := metrics
+	defer func() { metrics = oldMetrics }()
+	var err error
+	metrics, err = newMetricRegistry(append(defaultMetrics[:len(defaultMetrics):len(defaultMetrics)], &Metric{Name: "foo", Type: metricTypeInteger}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newInfluxDBSink(influxDBConfig{URL: "http://localhost:8086", Database: "db", Measurement: tt.measurement, Precision: tt.precision})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.point(tt.r); got != tt.want {
+				t.Errorf("point() = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// The sink's health can be checked while a batch is being retried.
+func TestInfluxDBSinkHealthDuringRetries(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s, err := newInfluxDBSink(influxDBConfig{URL: srv.URL, Database: "db", Measurement: "sensordata", Precision: "s", BatchSize: 1, Retries: 2, RetryWait: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		written <- s.Write(&Reading{DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"temp": 21.5}})
+	}()
+
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("no request sent")
+	}
+	checked := make(chan error, 1)
+	go func() {
+		checked <- s.Health()
+	}()
+	select {
+	case err := <-checked:
+		if err != nil {
+			t.Errorf("Health() = %v before the batch was dropped", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Health() waited for the retries")
+	}
+
+	if err := <-written; err == nil {
+		t.Error("Write() succeeded")
+	}
+	if len(requests) != 2 {
+		t.Errorf("%d requests sent, want 3", len(requests)+1)
+	}
+	if s.Health() == nil {
+		t.Error("Health() = nil after the batch was dropped")
+	}
+}
@@ -0,0 +1,43 @@
+// lock.go implements locking the directories that the spool and the readings
+// store write to, so that a replay can't write to them while the daemon
+// does and vice versa.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The name of the lock file in locked directories.
+const lockFile = ".lock"
+
+// The open lock files. They are kept open, and therefore locked, until the
+// process exits.
+var lockedDirs = make(map[string]*os.File)
+
+// lockDir takes an exclusive lock on a directory, creating it if necessary.
+// It returns an error if another process holds the lock.
+func lockDir(dir string) error {
+	if _, ok := lockedDirs[dir]; ok {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("%s is in use by another process", dir)
+		}
+		return err
+	}
+	lockedDirs[dir] = f
+	return nil
+}
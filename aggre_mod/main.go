@@ -1,12 +1,13 @@
 // Command aggre_mod is an aggregator for device data.
 // It receives data via the Particle pub/sub API
-// and writes it to fluentd on the
-// "aggre_mod.sensordata" channel.
+// and, optionally, an MQTT broker and writes it to
+// fluentd on the "aggre_mod.sensordata" channel
+// and any other configured outputs.
 
 package main
 
 import (
-	"bytes"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -14,19 +15,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/donovanhide/eventsource"
-	"github.com/fluent/fluent-logger-golang/fluent"
-	"github.com/najeira/ltsv"
 )
 
 //go:generate go run scripts/gen.go
 
-const PARTICLE_API_URL = "https://api.particle.io/v1/devices/events/weatherdata"
-
 // stringDefaults takes a default value and a list of string values and returns the first
 // non-empty value. If all values are empty or there are no values present
 // the default string value is returned.
@@ -67,40 +64,120 @@ func boolDefaults(def bool, val ...string) bool {
 }
 
 var (
-	addr = flag.String("host", stringDefaults(":8080", os.Getenv("ADDRESS")), "The web server address.")
+	addr         = flag.String("host", stringDefaults(":8080", os.Getenv("ADDRESS")), "The web server address.")
+	pipelineAddr = flag.String("pipeline-metrics-host", stringDefaults(":8081", os.Getenv("PIPELINE_METRICS_ADDRESS")), "The address of the web server serving pipeline metrics. If empty, pipeline metrics are not served.")
 
 	fluentdHost      = flag.String("fluentd-host", stringDefaults("localhost", os.Getenv("FLUENTD_HOST")), "The fluentd host.")
 	fluentdPort      = flag.Int("fluentd-port", intDefaults(24224, os.Getenv("FLUENTD_PORT")), "The fluentd port.")
 	fluentdRetryWait = flag.Int("fluentd-retry", intDefaults(500, os.Getenv("FLUENTD_RETRY_WAIT")), "Amount of time is milliseconds to wait between retries.")
-
-	accessTokenPath   = flag.String("access-token-path", stringDefaults("", os.Getenv("ACCESS_TOKEN_PATH")), "The path to a file containing the Particle API access token.")
+	fluentdAck       = flag.Bool("fluentd-require-ack", boolDefaults(true, os.Getenv("FLUENTD_REQUIRE_ACK")), "Wait for Fluentd to acknowledge each record before it counts as delivered.")
+
+	sinkNames           = flag.String("sinks", stringDefaults("fluentd", os.Getenv("SINKS")), "A comma separated list of outputs to write readings to: fluentd, stdout, file, influxdb, bigquery or mqtt.")
+	quarantineSinkNames = flag.String("quarantine-sinks", stringDefaults("", os.Getenv("QUARANTINE_SINKS")), "A comma separated list of outputs to write readings that fail validation to: fluentd, stdout or file. If empty, they are only logged.")
+	sinkQueueSize       = flag.Int("sink-queue", intDefaults(1000, os.Getenv("SINK_QUEUE_SIZE")), "The number of readings queued for each output. Readings are dropped for an output whose queue is full.")
+	sinkFlushInterval   = flag.Int("sink-flush-interval", intDefaults(1, os.Getenv("SINK_FLUSH_INTERVAL")), "The interval in seconds at which buffered readings are flushed to the outputs.")
+
+	fileSinkDir      = flag.String("file-sink-dir", stringDefaults("", os.Getenv("FILE_SINK_DIR")), "The directory the file output writes NDJSON files to.")
+	fileSinkMaxBytes = flag.Int("file-sink-max-bytes", intDefaults(64*1024*1024, os.Getenv("FILE_SINK_MAX_BYTES")), "The maximum size of an output file in bytes before a new file is started.")
+	fileSinkMaxFiles = flag.Int("file-sink-max-files", intDefaults(0, os.Getenv("FILE_SINK_MAX_FILES")), "The maximum number of output files to keep. If 0, old files are never removed.")
+
+	influxDBURL          = flag.String("influxdb-url", stringDefaults("http://localhost:8086", os.Getenv("INFLUXDB_URL")), "The base URL of the InfluxDB server.")
+	influxDBDatabase     = flag.String("influxdb-database", stringDefaults("", os.Getenv("INFLUXDB_DATABASE")), "The InfluxDB 1.x database to write to.")
+	influxDBUsername     = flag.String("influxdb-username", stringDefaults("", os.Getenv("INFLUXDB_USERNAME")), "The InfluxDB 1.x username.")
+	influxDBPasswordPath = flag.String("influxdb-password-path", stringDefaults("", os.Getenv("INFLUXDB_PASSWORD_PATH")), "The path to a file containing the InfluxDB 1.x password.")
+	influxDBOrg          = flag.String("influxdb-org", stringDefaults("", os.Getenv("INFLUXDB_ORG")), "The InfluxDB 2.x organization.")
+	influxDBBucket       = flag.String("influxdb-bucket", stringDefaults("", os.Getenv("INFLUXDB_BUCKET")), "The InfluxDB 2.x bucket to write to. If set, the 2.x write API is used.")
+	influxDBTokenPath    = flag.String("influxdb-token-path", stringDefaults("", os.Getenv("INFLUXDB_TOKEN_PATH")), "The path to a file containing the InfluxDB 2.x API token.")
+	influxDBMeasurement  = flag.String("influxdb-measurement", stringDefaults("sensordata", os.Getenv("INFLUXDB_MEASUREMENT")), "The InfluxDB measurement readings are written to.")
+	influxDBPrecision    = flag.String("influxdb-precision", stringDefaults("s", os.Getenv("INFLUXDB_PRECISION")), "The precision of InfluxDB point times: ns, us, ms or s.")
+	influxDBBatchSize    = flag.Int("influxdb-batch-size", intDefaults(500, os.Getenv("INFLUXDB_BATCH_SIZE")), "The maximum number of points written to InfluxDB in a single request.")
+	influxDBGzip         = flag.Bool("influxdb-gzip", boolDefaults(true, os.Getenv("INFLUXDB_GZIP")), "Compress requests to InfluxDB with gzip.")
+	influxDBRetries      = flag.Int("influxdb-retries", intDefaults(3, os.Getenv("INFLUXDB_RETRIES")), "The number of times a failed write to InfluxDB is retried before the points are dropped.")
+	influxDBRetryWait    = flag.Int("influxdb-retry", intDefaults(500, os.Getenv("INFLUXDB_RETRY_WAIT")), "Amount of time is milliseconds to wait between retries.")
+
+	bigQueryEndpoint  = flag.String("bigquery-endpoint", stringDefaults(bigQueryDefaultEndpoint, os.Getenv("BIGQUERY_ENDPOINT")), "The base URL of the BigQuery API.")
+	bigQueryProject   = flag.String("bigquery-project", stringDefaults("", os.Getenv("GCP_PROJECT")), "The Google Cloud project of the BigQuery table.")
+	bigQueryDataset   = flag.String("bigquery-dataset", stringDefaults("", os.Getenv("GCP_BIGQUERY_DATASET")), "The BigQuery dataset of the table.")
+	bigQueryTable     = flag.String("bigquery-table", stringDefaults("", os.Getenv("GCP_BIGQUERY_TABLE")), "The BigQuery table readings are inserted into.")
+	bigQueryKeyPath   = flag.String("bigquery-key-path", stringDefaults("", os.Getenv("GCP_SERVICE_ACCOUNT_KEY_PATH")), "The path to a service account JSON key used to authenticate to BigQuery. If empty, requests are not authenticated.")
+	bigQueryBatchSize = flag.Int("bigquery-batch-size", intDefaults(500, os.Getenv("BIGQUERY_BATCH_SIZE")), "The maximum number of rows inserted into BigQuery in a single request.")
+	bigQueryRetries   = flag.Int("bigquery-retries", intDefaults(3, os.Getenv("BIGQUERY_RETRIES")), "The number of times rows that could not be inserted into BigQuery are retried before they are dropped.")
+	bigQueryRetryWait = flag.Int("bigquery-retry", intDefaults(500, os.Getenv("BIGQUERY_RETRY_WAIT")), "Amount of time is milliseconds to wait between retries.")
+
+	spoolDir      = flag.String("spool-dir", stringDefaults("", os.Getenv("SPOOL_DIR")), "A directory to spool records to while Fluentd is unreachable. If empty, records that can't be sent are dropped.")
+	spoolMaxBytes = flag.Int("spool-max-bytes", intDefaults(256*1024*1024, os.Getenv("SPOOL_MAX_BYTES")), "The maximum size of the spool in bytes. The oldest records are dropped when it is full.")
+	spoolMaxAge   = flag.Int("spool-max-age", intDefaults(7*24*60*60, os.Getenv("SPOOL_MAX_AGE")), "The maximum age in seconds of spooled records. Older records are dropped.")
+
+	accessTokenPath   = flag.String("access-token-path", stringDefaults("", os.Getenv("ACCESS_TOKEN_PATH")), "The path to a file containing the Particle API access token. If empty, data is not read from the Particle API.")
 	particleRetryWait = flag.Int("particle-retry", intDefaults(500, os.Getenv("PARTICLE_RETRY_WAIT")), "Amount of time is milliseconds to wait between retries.")
+	particleAPIURL    = flag.String("particle-api-url", stringDefaults(PARTICLE_API_URL, os.Getenv("PARTICLE_API_URL")), "The base URL of the Particle API.")
+	particleEvents    = flag.String("particle-events", stringDefaults("weatherdata", os.Getenv("PARTICLE_EVENTS")), "A comma separated list of event name prefixes to subscribe to. A stream is opened for each prefix.")
+	particleProduct   = flag.String("particle-product", stringDefaults("", os.Getenv("PARTICLE_PRODUCT_ID")), "The ID or slug of a Particle product. If set, the product's event streams are used instead of the user's.")
+
+	mqttHost         = flag.String("mqtt-host", stringDefaults("", os.Getenv("MQTT_HOST")), "The MQTT broker host. If empty, data is not read from MQTT.")
+	mqttPort         = flag.Int("mqtt-port", intDefaults(8883, os.Getenv("MQTT_PORT")), "The MQTT broker port.")
+	mqttTLS          = flag.Bool("mqtt-tls", boolDefaults(true, os.Getenv("MQTT_TLS")), "Connect to the MQTT broker using TLS.")
+	mqttCAPath       = flag.String("mqtt-ca-path", stringDefaults("", os.Getenv("MQTT_CA_PATH")), "The path to a PEM file with the CA certificates that the MQTT broker's certificate is verified with. If empty, the system's CA certificates are used.")
+	mqttUsername     = flag.String("mqtt-username", stringDefaults("", os.Getenv("MQTT_USERNAME")), "The MQTT username.")
+	mqttPasswordPath = flag.String("mqtt-password-path", stringDefaults("", os.Getenv("MQTT_PASSWORD_PATH")), "The path to a file containing the MQTT password.")
+	mqttClientId     = flag.String("mqtt-client-id", stringDefaults("aggre_mod", os.Getenv("MQTT_CLIENT_ID")), "The MQTT client ID.")
+	mqttTopic        = flag.String("mqtt-topic", stringDefaults("home/+/climate", os.Getenv("MQTT_TOPIC")), "The MQTT topic filter to subscribe to.")
+	mqttRetryWait    = flag.Int("mqtt-retry", intDefaults(500, os.Getenv("MQTT_RETRY_WAIT")), "Amount of time is milliseconds to wait between retries.")
+
+	mqttPublishHost     = flag.String("mqtt-publish-host", stringDefaults("", os.Getenv("MQTT_PUBLISH_HOST")), "The MQTT broker host the mqtt output publishes to. If empty, -mqtt-host is used.")
+	mqttPublishPort     = flag.Int("mqtt-publish-port", intDefaults(0, os.Getenv("MQTT_PUBLISH_PORT")), "The MQTT broker port the mqtt output publishes to. If 0, -mqtt-port is used.")
+	mqttPublishClientId = flag.String("mqtt-publish-client-id", stringDefaults("aggre_mod-publisher", os.Getenv("MQTT_PUBLISH_CLIENT_ID")), "The MQTT client ID of the mqtt output.")
+	mqttPublishTopic    = flag.String("mqtt-publish-topic", stringDefaults("weathersensors/{device}/{metric}", os.Getenv("MQTT_PUBLISH_TOPIC")), "The template of the topics readings are published to. {device} and {metric} are replaced with the device ID and metric name. Without {metric}, readings are published as JSON records.")
+	mqttPublishQos      = flag.Int("mqtt-publish-qos", intDefaults(0, os.Getenv("MQTT_PUBLISH_QOS")), "The QoS level readings are published at: 0 or 1.")
+	mqttPublishRetain   = flag.Bool("mqtt-publish-retain", boolDefaults(true, os.Getenv("MQTT_PUBLISH_RETAIN")), "Publish readings as retained messages so that new subscribers receive the last values.")
+	mqttDiscovery       = flag.Bool("mqtt-discovery", boolDefaults(false, os.Getenv("MQTT_DISCOVERY")), "Publish Home Assistant MQTT discovery configs for the sensors of every device with the mqtt output.")
+	mqttDiscoveryPrefix = flag.String("mqtt-discovery-prefix", stringDefaults("homeassistant", os.Getenv("MQTT_DISCOVERY_PREFIX")), "The Home Assistant discovery prefix.")
+	mqttAvailability    = flag.String("mqtt-availability-topic", stringDefaults("weathersensors/{device}/availability", os.Getenv("MQTT_AVAILABILITY_TOPIC")), "The template of the topics the availability (online or offline) of devices is published to. If empty, availability is not published.")
+
+	captureDir      = flag.String("capture-dir", stringDefaults("", os.Getenv("CAPTURE_DIR")), "A directory to capture raw Particle API messages to for later replay. If empty, messages are not captured.")
+	captureMaxBytes = flag.Int("capture-max-bytes", intDefaults(64*1024*1024, os.Getenv("CAPTURE_MAX_BYTES")), "The maximum size of a capture file in bytes before a new file is started.")
+	captureMaxFiles = flag.Int("capture-max-files", intDefaults(0, os.Getenv("CAPTURE_MAX_FILES")), "The maximum number of capture files to keep. If 0, old files are never removed.")
+
+	metricsPath = flag.String("metrics-path", stringDefaults("", os.Getenv("METRICS_PATH")), "The path to a JSON file listing the metrics that devices report. If empty, the default metrics are used.")
+
+	clockSkewThreshold = flag.Int("clock-skew-threshold", intDefaults(300, os.Getenv("CLOCK_SKEW_THRESHOLD")), "The difference in seconds between a reading's timestamp and the time it was published to the Particle API above which the device's clock is considered skewed.")
+	clockSkewAction    = flag.String("clock-skew-action", stringDefaults(skewActionKeep, os.Getenv("CLOCK_SKEW_ACTION")), "What to do with the timestamps of readings from skewed devices: keep them, replace them with the publish time or correct them by the device's typical skew.")
+
+	dedupWindow = flag.Int("dedup-window", intDefaults(600, os.Getenv("DEDUP_WINDOW")), "The time in seconds within which readings with the same device, timestamp and values are dropped as duplicates. If 0, duplicates aren't dropped.")
 
-	deviceTimeout = flag.Int("deviceTimeout", intDefaults(300, os.Getenv("DEVICE_TIMEOUT")), "The device timeout in seconds.")
+	outlierWindow = flag.Int("outlier-window", intDefaults(10, os.Getenv("OUTLIER_WINDOW")), "The number of recent values of each device and metric that new values are compared to when looking for outliers. If 0, outliers aren't filtered.")
+	outlierMADs   = flag.Int("outlier-mads", intDefaults(5, os.Getenv("OUTLIER_MADS")), "The number of median absolute deviations from the median of recent values after which a value is an outlier. If 0, only the max_rate of metrics is checked.")
+	outlierAction = flag.String("outlier-action", stringDefaults(outlierActionFlag, os.Getenv("OUTLIER_ACTION")), "What to do with outliers: flag them in records with the quality and outliers fields or drop them.")
+
+	deviceTimeout  = flag.Int("deviceTimeout", intDefaults(300, os.Getenv("DEVICE_TIMEOUT")), "The device timeout in seconds.")
+	deviceInfoPath = flag.String("device-info-path", stringDefaults("", os.Getenv("DEVICE_INFO_PATH")), "The path to a JSON file mapping device IDs to device names and locations.")
+	deviceHistory  = flag.Int("device-history", intDefaults(60, os.Getenv("DEVICE_HISTORY")), "The number of recent readings to keep for each device.")
+
+	streamBuffer = flag.Int("stream-buffer", intDefaults(1000, os.Getenv("STREAM_BUFFER")), "The number of recent events kept for clients of /api/stream that resume with Last-Event-ID.")
+
+	promHorizon = flag.Int("prometheus-horizon", intDefaults(3600, os.Getenv("PROMETHEUS_HORIZON")), "The time in seconds after which devices that haven't been seen are left out of /metrics. If 0, devices are never left out.")
+
+	storeDir       = flag.String("store-dir", stringDefaults("", os.Getenv("STORE_DIR")), "A directory to store every reading in so that history can be queried on /api/devices/{id}/readings. If empty, readings are not stored.")
+	storeRetention = flag.Int("store-retention", intDefaults(365, os.Getenv("STORE_RETENTION")), "The number of days readings and minute rollups are kept in the store. If 0, they are kept forever.")
+	rollupTimezone = flag.String("rollup-timezone", stringDefaults("UTC", os.Getenv("ROLLUP_TIMEZONE")), "The time zone that hourly and daily rollups start in, e.g. Asia/Tokyo.")
+
+	statePath     = flag.String("state-path", stringDefaults("", os.Getenv("STATE_PATH")), "The path to a file the device state is saved to and restored from at startup. If empty, device state is not saved.")
+	stateInterval = flag.Int("state-interval", intDefaults(60, os.Getenv("STATE_INTERVAL")), "The interval in seconds at which device state is saved.")
 
 	version = flag.Bool("version", false, "Print the version and exit.")
 )
 
-var (
-	fluentdConnected     = false
-	particleAPIConnected = false
-)
+// The outputs that readings are written to.
+var sinks *sinkSet
 
-type Device struct {
-	Id            string   `json:"id"`
-	Temp          *float64 `json:"current_temp"`
-	Humidity      *float64 `json:"current_humidity"`
-	Pressure      *float64 `json:"current_pressure"`
-	WindSpeed     *float64 `json:"current_windspeed"`
-	WindDirection *float64 `json:"current_winddirection"`
-	Rainfall      *float64 `json:"current_rainfall"`
-	LastSeen      int64    `json:"last_seen"`
-	Active        bool     `json:"active"`
-}
+// The sources that data is being read from.
+var sources = []Source{}
 
-// A list of currently known devices
-var Devices = []Device{}
-var DeviceChan = make(chan map[string]interface{}, 100)
+// The registry of known devices.
+var devices *deviceRegistry
+
+// The stream of readings served on /api/stream.
+var stream *readingStream
 
 // Gets the access token for the Particle API by reading it from
 // the access token secret file.
@@ -117,282 +194,277 @@ func getAccessToken() string {
 	return string(b)
 }
 
-// Data message from the Particle API
-type Message struct {
-	Id          string `json:"coreid"`
-	Data        string `json:"data"`
-	Ttl         string `json:"ttl"`
-	PublishedAt string `json:"published_at"`
+// Gets the password for the MQTT broker by reading it from the
+// password secret file. An empty password is returned if no
+// file was given.
+func getMQTTPassword() string {
+	return readSecretFile(*mqttPasswordPath, "MQTT password")
 }
 
-// addFloatValue takes a string containing a float value and adds it to a JSON object.
-func addFloatValue(name string, jsonValue map[string]interface{}, data map[string]string) {
-	if data[name] != "" {
-		if val, err := strconv.ParseFloat(data[name], 64); err == nil {
-			jsonValue[name] = val
-		} else {
-			log.Printf("Error parsing %s data: %v", name, err)
-		}
+// getMQTTRootCAs returns the CA certificates the MQTT broker is verified with
+// or nil if the system's are used.
+func getMQTTRootCAs() *x509.CertPool {
+	if *mqttCAPath == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(*mqttCAPath)
+	if err != nil {
+		log.Fatal("Could not read MQTT CA certificates: ", err)
 	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		log.Fatalf("No certificates found in %s.", *mqttCAPath)
+	}
+	return pool
 }
 
-// connectToFluentd continuously tries to connect to Fluentd.
-func connectToFluentd() *fluent.Fluent {
-	var err error
-	var logger *fluent.Fluent
+// readSecretFile reads a secret such as a password from a file. An empty
+// string is returned if path is empty.
+func readSecretFile(path, name string) string {
+	if path == "" {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Could not open %s file: %v", name, err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Fatalf("Could not open %s file: %v", name, err)
+	}
+	return strings.Trim(string(b), " \t\n")
+}
 
+// connectToFluentd continuously tries to connect to Fluentd.
+func connectToFluentd(w *fluentdWriter) {
 	// Continuously try to connect to Fluentd.
 	backoff := time.Duration(*fluentdRetryWait) * time.Millisecond
 	for {
 		log.Printf("Connecting to Fluentd (%s:%d)...", *fluentdHost, *fluentdPort)
-		logger, err = fluent.New(fluent.Config{
-			FluentHost: *fluentdHost,
-			FluentPort: *fluentdPort,
-			// Once we have a connection, the library will reconnect automatically
-			// if the connection is lost. However, it panics if it fails to connect
-			// more than MaxRetry times. To avoid panics crashing the server, retry
-			// many times before panicking.
-			MaxRetry:  240,
-			RetryWait: *fluentdRetryWait,
-		})
-		if err != nil {
+		if err := w.Connect(); err != nil {
 			log.Printf("Could not connect to Fluentd: %v", err)
 			time.Sleep(backoff)
 			backoff *= 2
 		} else {
 			log.Printf("Connected to Fluentd (%s:%d)...", *fluentdHost, *fluentdPort)
-			return logger
+			return
 		}
 	}
 }
 
-// connectToParticle continuously tries to connect to the Particle API.
-func connectToParticle(accessToken string) *eventsource.Stream {
-	backoff := time.Duration(*particleRetryWait) * time.Millisecond
-
-	for {
-		req, err := http.NewRequest("GET", PARTICLE_API_URL, nil)
-		if err != nil {
-			log.Fatalf("Could not create request: %v", err)
-			time.Sleep(time.Duration(*particleRetryWait) * time.Millisecond)
-			continue
-		}
-
-		req.Header.Set("Authorization", "Bearer "+accessToken)
-		log.Printf("Connecting to Particle API...")
-		stream, err := eventsource.SubscribeWithRequest("", req)
-		if err != nil {
-			log.Printf("Could not subscribe to Particle API stream: %v", err)
-			time.Sleep(backoff)
-			backoff *= 2
-		} else {
-			log.Printf("Connected to Particle API...")
-			return stream
-		}
+// createMQTTPublisher creates the mqtt output. It connects with the same
+// TLS settings and credentials as the MQTT source.
+func createMQTTPublisher() *mqttPublisher {
+	host := stringDefaults(*mqttHost, *mqttPublishHost)
+	if host == "" {
+		log.Fatal("The mqtt output requires -mqtt-publish-host or -mqtt-host.")
 	}
+	port := *mqttPublishPort
+	if port == 0 {
+		port = *mqttPort
+	}
+	if *mqttPublishQos < 0 || *mqttPublishQos > 1 {
+		log.Fatal("-mqtt-publish-qos must be 0 or 1.")
+	}
+	discoveryPrefix := ""
+	if *mqttDiscovery {
+		discoveryPrefix = *mqttDiscoveryPrefix
+	}
+	return newMQTTPublisher(mqttConfig{
+		Host:      host,
+		Port:      port,
+		TLS:       *mqttTLS,
+		RootCAs:   getMQTTRootCAs(),
+		ClientId:  *mqttPublishClientId,
+		Username:  *mqttUsername,
+		Password:  getMQTTPassword(),
+		KeepAlive: 60 * time.Second,
+	}, mqttPublisherConfig{
+		Topic:             *mqttPublishTopic,
+		AvailabilityTopic: *mqttAvailability,
+		Qos:               byte(*mqttPublishQos),
+		Retain:            *mqttPublishRetain,
+		DiscoveryPrefix:   discoveryPrefix,
+		RetryWait:         time.Duration(*mqttRetryWait) * time.Millisecond,
+	})
 }
 
-// processData processes data incoming from devices and sends them over to Fluentd
-func processData(accessToken string) {
-	var err error
-
-	// Connect to Fluentd
-	logger := connectToFluentd()
-	fluentdConnected = true
-
-	// The stream object reconnects with exponential backoff.
-	stream := connectToParticle(accessToken)
-	particleAPIConnected = true
+// openReadingStore opens the store in the store directory.
+func openReadingStore() *readingStore {
+	loc, err := time.LoadLocation(*rollupTimezone)
+	if err != nil {
+		log.Fatal("Could not load rollup time zone: ", err)
+	}
+	s, err := openStore(*storeDir, time.Duration(*storeRetention)*24*time.Hour, loc)
+	if err != nil {
+		log.Fatal("Could not open readings store: ", err)
+	}
+	return s
+}
 
-	// Now actually process events.
-	for {
-		// Block on the data/error channels.
-		select {
-		case event := <-stream.Events:
-			// Unmarshall the JSON data from the Particle API.
-			//////////////////////////////////////////////////////////////////
-			var m Message
-			jsonData := event.Data()
-			// The particle API often sends newlines.
-			// Perhaps as a keep-alive mechanism.
-			if jsonData == "" {
-				continue
+// createSinks creates the outputs listed in the sinks flag and the readings
+// store if a store directory is set.
+func createSinks() []Sink {
+	created := []Sink{}
+	for _, name := range strings.Split(*sinkNames, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "fluentd":
+			var sp *spool
+			if *spoolDir != "" {
+				if err := lockDir(*spoolDir); err != nil {
+					log.Fatal("Could not lock spool: ", err)
+				}
+				var err error
+				sp, err = openSpool(*spoolDir, int64(*spoolMaxBytes), time.Duration(*spoolMaxAge)*time.Second)
+				if err != nil {
+					log.Fatal("Could not open spool: ", err)
+				}
 			}
-			err = json.Unmarshal([]byte(jsonData), &m)
-			if err != nil {
-				log.Printf("Could not parse message data: %v", err)
-				continue
+			created = append(created, newFluentdSink(newFluentdWriter(*fluentdHost, *fluentdPort, *fluentdAck), fluentdTag, sp, time.Duration(*fluentdRetryWait)*time.Millisecond))
+		case "stdout":
+			created = append(created, newStdoutSink())
+		case "file":
+			if *fileSinkDir == "" {
+				log.Fatal("The file output requires -file-sink-dir.")
 			}
-
-			// Read LTSV data from the device into map[string]string
-			//////////////////////////////////////////////////////////////////
-			reader := ltsv.NewReader(bytes.NewBufferString(m.Data))
-			records, err := reader.ReadAll()
-			if err != nil || len(records) != 1 {
-				log.Printf("Error reading LTSV data: %v", err)
-				continue
+			s, err := newFileSink(*fileSinkDir, "readings", int64(*fileSinkMaxBytes), *fileSinkMaxFiles)
+			if err != nil {
+				log.Fatal("Could not create file output: ", err)
 			}
-
-			data := records[0]
-			log.Printf("Got data: %v", data)
-
-			// Put the data into jsonValue and send to Fluentd
-			//////////////////////////////////////////////////////////////////
-			jsonValue := make(map[string]interface{})
-
-			jsonValue["deviceid"] = m.Id
-
-			timestamp, err := strconv.ParseInt(data["timestamp"], 10, 64)
+			created = append(created, s)
+		case "influxdb":
+			s, err := newInfluxDBSink(influxDBConfig{
+				URL:         *influxDBURL,
+				Database:    *influxDBDatabase,
+				Username:    *influxDBUsername,
+				Password:    readSecretFile(*influxDBPasswordPath, "InfluxDB password"),
+				Org:         *influxDBOrg,
+				Bucket:      *influxDBBucket,
+				Token:       readSecretFile(*influxDBTokenPath, "InfluxDB token"),
+				Measurement: *influxDBMeasurement,
+				Precision:   *influxDBPrecision,
+				BatchSize:   *influxDBBatchSize,
+				Gzip:        *influxDBGzip,
+				Retries:     *influxDBRetries,
+				RetryWait:   time.Duration(*influxDBRetryWait) * time.Millisecond,
+			})
 			if err != nil {
-				log.Printf("Error reading timestamp: %v", err)
-				continue
+				log.Fatal("Could not create InfluxDB output: ", err)
 			}
-
-			jsonValue["timestamp"] = timestamp
-			addFloatValue("temp", jsonValue, data)
-			addFloatValue("humidity", jsonValue, data)
-			addFloatValue("pressure", jsonValue, data)
-			addFloatValue("windspeed", jsonValue, data)
-			addFloatValue("winddirection", jsonValue, data)
-			addFloatValue("rainfall", jsonValue, data)
-
-			DeviceChan <- jsonValue
-
-			// Send data directly to Fluentd
-			if err = logger.Post("aggre_mod.sensordata", jsonValue); err != nil {
-				log.Printf("Could not send data from %s to Fluentd: %v", m.Id, err)
-			} else {
-				log.Printf("Data processed (%s): %s", m.Id, data)
+			created = append(created, s)
+		case "bigquery":
+			config := bigQueryConfig{
+				Endpoint:  *bigQueryEndpoint,
+				Project:   *bigQueryProject,
+				Dataset:   *bigQueryDataset,
+				Table:     *bigQueryTable,
+				BatchSize: *bigQueryBatchSize,
+				Retries:   *bigQueryRetries,
+				RetryWait: time.Duration(*bigQueryRetryWait) * time.Millisecond,
 			}
-		case err := <-stream.Errors:
-			log.Printf("Stream error: %v", err)
-		}
-	}
-}
-
-// updateDevices updates devices periodically with the latest data.
-func updateDevices() {
-	// TODO: Need to split up this logic.
-	for {
-		select {
-		case deviceInfo := <-DeviceChan:
-			log.Println("Updating device:", deviceInfo["deviceid"])
-			updateDevice(deviceInfo)
-		default:
-			for i, d := range Devices {
-				active := time.Now().Unix()-d.LastSeen < int64(*deviceTimeout)
-				if d.Active && !active {
-					// Log a warning if a device is no longer active.
-					log.Println("Device no longer active:", d.Id)
+			if *bigQueryKeyPath != "" {
+				tokens, err := loadGoogleTokenSource(*bigQueryKeyPath, bigQueryScope)
+				if err != nil {
+					log.Fatal("Could not load service account key: ", err)
 				}
-				// Update the active flag.
-				Devices[i].Active = active
+				config.Tokens = tokens
+			}
+			s, err := newBigQuerySink(config)
+			if err != nil {
+				log.Fatal("Could not create BigQuery output: ", err)
 			}
-			// Throttle the loop if there is no data.
-			time.Sleep(1 * time.Second)
+			created = append(created, s)
+		case "mqtt":
+			created = append(created, createMQTTPublisher())
+		default:
+			log.Fatalf("Unknown output %q.", name)
 		}
 	}
-}
-
-// Updates a device with it's current status.
-func updateDevice(jsonValue map[string]interface{}) {
-	lastSeen := jsonValue["timestamp"].(int64)
-	active := time.Now().Unix()-lastSeen < int64(*deviceTimeout)
-
-	for _, d := range Devices {
-		if d.Id == jsonValue["deviceid"].(string) {
-			// Update known device
-			if temp, ok := jsonValue["temp"]; ok {
-				tempFloat := temp.(float64)
-				d.Temp = &tempFloat
-			} else {
-				d.Temp = nil
-			}
-			if humidity, ok := jsonValue["humidity"]; ok {
-				hFloat := humidity.(float64)
-				d.Humidity = &hFloat
-			} else {
-				d.Humidity = nil
-			}
-			if pressure, ok := jsonValue["pressure"]; ok {
-				pFloat := pressure.(float64)
-				d.Pressure = &pFloat
-			} else {
-				d.Pressure = nil
-			}
-			if windspeed, ok := jsonValue["windspeed"]; ok {
-				wsFloat := windspeed.(float64)
-				d.WindSpeed = &wsFloat
-			} else {
-				d.WindSpeed = nil
-			}
-			if winddirection, ok := jsonValue["winddirection"]; ok {
-				wdFloat := winddirection.(float64)
-				d.WindDirection = &wdFloat
-			} else {
-				d.WindDirection = nil
-			}
-			if rainfall, ok := jsonValue["rainfall"]; ok {
-				rFloat := rainfall.(float64)
-				d.Rainfall = &rFloat
-			} else {
-				d.Rainfall = nil
+	if *storeDir != "" {
+		if err := lockDir(*storeDir); err != nil {
+			log.Fatal("Could not lock readings store: ", err)
+		}
+		store = openReadingStore()
+		created = append(created, store)
+	}
+	for _, name := range splitList(*quarantineSinkNames) {
+		var s Sink
+		switch name {
+		case "fluentd":
+			s = newFluentdSink(newFluentdWriter(*fluentdHost, *fluentdPort, *fluentdAck), fluentdQuarantineTag, nil, time.Duration(*fluentdRetryWait)*time.Millisecond)
+		case "stdout":
+			s = newStdoutSink()
+		case "file":
+			if *fileSinkDir == "" {
+				log.Fatal("The file output requires -file-sink-dir.")
 			}
-			d.LastSeen = lastSeen
-			if d.Active && !active {
-				// Log a warning if a device is no longer active.
-				log.Println("Device no longer active:", d.Id)
+			var err error
+			s, err = newFileSink(*fileSinkDir, "quarantine", int64(*fileSinkMaxBytes), *fileSinkMaxFiles)
+			if err != nil {
+				log.Fatal("Could not create file output: ", err)
 			}
-			d.Active = active
-			return
+		default:
+			log.Fatalf("Output %q can't be used for quarantined readings.", name)
 		}
+		created = append(created, &quarantineSink{s})
 	}
-
-	// New device
-	d := Device{
-		Id:       jsonValue["deviceid"].(string),
-		LastSeen: lastSeen,
-		Active:   active,
+	if len(created) == 0 {
+		log.Fatal("No outputs configured.")
 	}
+	return created
+}
 
-	if temp, ok := jsonValue["temp"]; ok {
-		tempFloat := temp.(float64)
-		d.Temp = &tempFloat
-	} else {
-		d.Temp = nil
+// processReading runs a reading through the duplicate, clock skew,
+// validation and outlier filters. Readings that fail validation are kept
+// with their Rejection set so that they can be quarantined. It returns false
+// if the reading is dropped.
+func processReading(r *Reading) bool {
+	if !dedup.Check(r) {
+		log.Printf("Duplicate data skipped (%s via %s): %s", r.DeviceId, r.Source, r.Id)
+		return false
 	}
-	if humidity, ok := jsonValue["humidity"]; ok {
-		hFloat := humidity.(float64)
-		d.Humidity = &hFloat
-	} else {
-		d.Humidity = nil
+	skews.Check(r)
+	if r.Rejection = validateReading(r); r.Rejection != nil {
+		log.Printf("Data quarantined (%s via %s): %s: %s", r.DeviceId, r.Source, r.Rejection.Metric, r.Rejection.Message)
+		return true
 	}
-	if pressure, ok := jsonValue["pressure"]; ok {
-		pFloat := pressure.(float64)
-		d.Pressure = &pFloat
-	} else {
-		d.Pressure = nil
+	if !outliers.Check(r) {
+		log.Printf("Data dropped (%s via %s): every value is an outlier: %v", r.DeviceId, r.Source, r.Outliers)
+		return false
 	}
-	if windspeed, ok := jsonValue["windspeed"]; ok {
-		wsFloat := windspeed.(float64)
-		d.WindSpeed = &wsFloat
-	} else {
-		d.WindSpeed = nil
-	}
-	if winddirection, ok := jsonValue["winddirection"]; ok {
-		wdFloat := winddirection.(float64)
-		d.WindDirection = &wdFloat
-	} else {
-		d.WindDirection = nil
-	}
-	if rainfall, ok := jsonValue["rainfall"]; ok {
-		rFloat := rainfall.(float64)
-		d.Rainfall = &rFloat
-	} else {
-		d.Rainfall = nil
+	log.Printf("Data processed (%s via %s): %v", r.DeviceId, r.Source, r.Values)
+	return true
+}
+
+// processData starts the given sources and writes the data they receive from
+// devices to the outputs.
+func processData(sources []Source) {
+	readings := make(chan *Reading, 100)
+	errs := make(chan error, 100)
+	queueLength.Set("readings", func() float64 { return float64(len(readings)) })
+	for _, s := range sources {
+		s.Start(readings, errs)
 	}
 
-	Devices = append(Devices, d)
+	// Now actually process readings.
+	for {
+		select {
+		case r := <-readings:
+			if !processReading(r) {
+				continue
+			}
+			// Quarantined readings don't update the device state.
+			if r.Rejection == nil {
+				devices.Update(r)
+			}
+			sinks.Write(r)
+		case err := <-errs:
+			log.Printf("Source error: %v", err)
+		}
+	}
 }
 
 // the logger as an io.Writer
@@ -406,17 +478,29 @@ func (w LogWriter) Write(b []byte) (int, error) {
 // Returns the health status of the app.
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	errorMsg := []string{}
-	if !fluentdConnected {
-		errorMsg = append(errorMsg, "fluentd: Not connected.")
+	status := []string{}
+	for _, s := range sinks.Sinks() {
+		if err := s.Health(); err != nil {
+			errorMsg = append(errorMsg, s.Name()+": "+err.Error())
+		}
+		if st, ok := s.(sinkStatus); ok && st.Status() != "" {
+			status = append(status, st.Status())
+		}
 	}
-	if !particleAPIConnected {
-		errorMsg = append(errorMsg, "particle: Not connected.")
+	for _, s := range sources {
+		if !s.Connected() {
+			errorMsg = append(errorMsg, s.Name()+": Not connected.")
+		}
 	}
 
-	if fluentdConnected && particleAPIConnected {
+	if len(errorMsg) == 0 {
 		fmt.Fprintf(w, "OK")
+		for _, st := range status {
+			fmt.Fprintf(w, "\n%s", st)
+		}
 	} else {
-		http.Error(w, strings.Join(errorMsg, "\n"), http.StatusInternalServerError)
+		// The status shows how much data is waiting while outputs fail.
+		http.Error(w, strings.Join(append(errorMsg, status...), "\n"), http.StatusInternalServerError)
 	}
 }
 
@@ -425,10 +509,271 @@ func versionHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, VERSION)
 }
 
+// Returns the number of payloads decoded and parse errors by format.
+func decodeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(payloadStats.snapshot())
+}
+
 func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	sel, err := parseUnitsParam(r.URL.Query().Get("units"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list := devices.Snapshot()
+	// ?skewed=true lists only the devices whose clock is skewed.
+	if r.URL.Query().Get("skewed") == "true" {
+		skewed := []Device{}
+		for _, d := range list {
+			if d.ClockSkewed {
+				skewed = append(skewed, d)
+			}
+		}
+		list = skewed
+	}
+	records := []map[string]interface{}{}
+	for _, d := range list {
+		records = append(records, d.Record(sel))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	dec := json.NewEncoder(w)
-	dec.Encode(Devices)
+	dec.Encode(records)
+}
+
+// Serves a single device at /api/devices/{id}, its most recent readings at
+// /api/devices/{id}/recent and its stored readings and rollups at
+// /api/devices/{id}/readings and /api/devices/{id}/rollups. Values are
+// converted to the units given in the units parameter.
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+	id := parts[0]
+
+	sel, err := parseUnitsParam(r.URL.Query().Get("units"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var v interface{}
+	var ok bool
+	switch {
+	case len(parts) == 1:
+		var d Device
+		d, ok = devices.Get(id)
+		v = d.Record(sel)
+	case len(parts) == 2 && parts[1] == "readings":
+		deviceReadingsHandler(w, r, id, sel)
+		return
+	case len(parts) == 2 && parts[1] == "rollups":
+		deviceRollupsHandler(w, r, id, sel)
+		return
+	case len(parts) == 2 && parts[1] == "recent":
+		var readings []*Reading
+		readings, ok = devices.Recent(id)
+		records := []map[string]interface{}{}
+		for _, reading := range readings {
+			record := reading.Record()
+			sel.ConvertRecord(record)
+			records = append(records, record)
+		}
+		v = records
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(v)
+}
+
+// parseTimeParam parses a time given as RFC 3339 or in seconds since the
+// epoch. def is returned if s is empty.
+func parseTimeParam(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return secs, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Unix(), nil
+}
+
+// parseMetricsParam parses a comma separated list of metric names. All
+// metrics are returned if s is empty.
+func parseMetricsParam(s string) ([]*Metric, error) {
+	if s == "" {
+		return metrics.Metrics, nil
+	}
+	list := []*Metric{}
+	for _, name := range strings.Split(s, ",") {
+		m := metrics.Get(strings.TrimSpace(name))
+		if m == nil {
+			return nil, fmt.Errorf("unknown metric %q", name)
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+// Serves the stored readings of a device taken between the from and to
+// query parameters, the last day by default. Only the metrics listed in the
+// metrics parameter are included. Results are paginated: if there are more
+// than limit readings, next_cursor is set and can be passed as the cursor
+// parameter to get the next page.
+func deviceReadingsHandler(w http.ResponseWriter, r *http.Request, id string, sel unitSelection) {
+	if store == nil {
+		http.Error(w, "The readings store is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	now := time.Now().Unix()
+	to, err := parseTimeParam(q.Get("to"), now+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(q.Get("from"), to-24*60*60)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := parseMetricsParam(q.Get("metrics"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 1000
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 10000 {
+			http.Error(w, "limit must be between 1 and 10000", http.StatusBadRequest)
+			return
+		}
+	}
+	var after *storeCursor
+	if c := q.Get("cursor"); c != "" {
+		cursor, err := parseStoreCursor(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		after = &cursor
+	}
+
+	readings, next, err := store.Query(id, from, to, after, limit)
+	if err != nil {
+		log.Printf("Could not query readings of %s: %v", id, err)
+		http.Error(w, "Could not query readings.", http.StatusInternalServerError)
+		return
+	}
+
+	records := []map[string]interface{}{}
+	for _, reading := range readings {
+		record := map[string]interface{}{
+			"timestamp": reading.Timestamp,
+		}
+		for _, m := range list {
+			if val, ok := reading.Values[m.Name]; ok {
+				record[m.Name] = sel.Value(m, val)
+			}
+		}
+		reading.annotateOutliers(record)
+		records = append(records, record)
+	}
+	resp := map[string]interface{}{
+		"deviceid": id,
+		"units":    sel.Units(list),
+		"readings": records,
+	}
+	if next != nil {
+		resp["next_cursor"] = next.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(resp)
+}
+
+// Serves the rollups of a device's stored readings at the resolution given
+// by the resolution query parameter for buckets overlapping the from and to
+// parameters, the last day by default. Only the metrics listed in the
+// metrics parameter are included.
+func deviceRollupsHandler(w http.ResponseWriter, r *http.Request, id string, sel unitSelection) {
+	if store == nil {
+		http.Error(w, "The readings store is not enabled.", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	res := getRollupResolution(stringDefaults("1h", q.Get("resolution")))
+	if res == nil {
+		http.Error(w, "resolution must be 1m, 1h or 1d", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().Unix()
+	to, err := parseTimeParam(q.Get("to"), now+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(q.Get("from"), to-24*60*60)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	list, err := parseMetricsParam(q.Get("metrics"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := store.rollups.Query(id, res, from, to)
+	if err != nil {
+		log.Printf("Could not query rollups of %s: %v", id, err)
+		http.Error(w, "Could not query rollups.", http.StatusInternalServerError)
+		return
+	}
+
+	records := []map[string]interface{}{}
+	for _, b := range buckets {
+		record := map[string]interface{}{
+			"start": b.Start,
+		}
+		for _, m := range list {
+			if s, ok := b.Stats[m.Name]; ok {
+				record[m.Name] = map[string]interface{}{
+					"min":   sel.Convert(m, s.Min),
+					"max":   sel.Convert(m, s.Max),
+					"mean":  sel.Convert(m, s.Sum/float64(s.Count)),
+					"count": s.Count,
+					"first": sel.Convert(m, s.First),
+					"last":  sel.Convert(m, s.Last),
+				}
+			}
+		}
+		records = append(records, record)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{
+		"deviceid":   id,
+		"resolution": res.Name,
+		"timezone":   store.rollups.loc.String(),
+		"units":      sel.Units(list),
+		"rollups":    records,
+	})
 }
 
 func main() {
@@ -439,20 +784,167 @@ func main() {
 		return
 	}
 
-	// Get the API access token
-	accessToken := getAccessToken()
+	var err error
+	metrics, err = loadMetricRegistry(*metricsPath)
+	if err != nil {
+		log.Fatal("Could not load metrics: ", err)
+	}
 
-	// Process data in the background.
-	go processData(accessToken)
+	skews, err = newSkewFilter(time.Duration(*clockSkewThreshold)*time.Second, *clockSkewAction)
+	if err != nil {
+		log.Fatal("Could not create clock skew filter: ", err)
+	}
+	if *dedupWindow > 0 {
+		dedup = newDedupFilter(time.Duration(*dedupWindow) * time.Second)
+	}
+	if *outlierWindow > 0 {
+		outliers, err = newOutlierFilter(*outlierWindow, *outlierMADs, *outlierAction)
+		if err != nil {
+			log.Fatal("Could not create outlier filter: ", err)
+		}
+	}
+
+	if flag.Arg(0) == "schema" {
+		// Print the BigQuery table schema for the configured metrics.
+		b, err := json.MarshalIndent(metrics.BigQuerySchema(), "", "    ")
+		if err != nil {
+			log.Fatal("Could not encode schema: ", err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+
+	if flag.Arg(0) == "replay" {
+		replayCommand(flag.Args()[1:])
+		return
+	}
+
+	if flag.Arg(0) == "export" {
+		exportCommand(flag.Args()[1:])
+		return
+	}
+
+	if *accessTokenPath != "" {
+		var capture *captureWriter
+		if *captureDir != "" {
+			capture, err = newCaptureWriter(*captureDir, int64(*captureMaxBytes), *captureMaxFiles)
+			if err != nil {
+				log.Fatal("Could not create capture directory: ", err)
+			}
+			defer capture.Close()
+		}
+		accessToken := getAccessToken()
+		for _, prefix := range strings.Split(*particleEvents, ",") {
+			prefix = strings.TrimSpace(prefix)
+			if prefix == "" {
+				continue
+			}
+			sources = append(sources, newParticleSource(accessToken, *particleAPIURL, *particleProduct, prefix, time.Duration(*particleRetryWait)*time.Millisecond, capture))
+		}
+	}
+	if *mqttHost != "" {
+		sources = append(sources, newMQTTSource(mqttConfig{
+			Host:      *mqttHost,
+			Port:      *mqttPort,
+			TLS:       *mqttTLS,
+			RootCAs:   getMQTTRootCAs(),
+			ClientId:  *mqttClientId,
+			Username:  *mqttUsername,
+			Password:  getMQTTPassword(),
+			KeepAlive: 60 * time.Second,
+		}, *mqttTopic, time.Duration(*mqttRetryWait)*time.Millisecond))
+	}
+	if len(sources) == 0 {
+		log.Fatal("No sources configured. Set the Particle API access token path or the MQTT host.")
+	}
+
+	outputs := createSinks()
+	stream = newReadingStream(*streamBuffer)
+	outputs = append(outputs, stream)
+	sinks = newSinkSet(outputs, *sinkQueueSize, time.Duration(*sinkFlushInterval)*time.Second)
 
 	// Update device data periodically.
-	go updateDevices()
+	devices = newDeviceRegistry(time.Duration(*deviceTimeout)*time.Second, *deviceHistory)
+	devices.OnActiveChange(stream.PublishDevice)
+	for _, s := range outputs {
+		if p, ok := s.(*mqttPublisher); ok {
+			devices.OnActiveChange(p.PublishDevice)
+		}
+	}
+	if *deviceInfoPath != "" {
+		info, err := loadDeviceInfo(*deviceInfoPath)
+		if err != nil {
+			log.Fatal("Could not load device info: ", err)
+		}
+		devices.SetInfo(info)
+	}
+	if *statePath != "" {
+		if err := loadDeviceState(devices, *statePath); err != nil {
+			log.Printf("Could not restore device state from %s: %v", *statePath, err)
+		}
+		go persistDeviceState(devices, *statePath, time.Duration(*stateInterval)*time.Second)
+	}
+	go devices.watch(1 * time.Second)
+
+	// Connect the outputs once the registry is restored so that discovery
+	// configs are published for the restored devices.
+	for _, s := range outputs {
+		if q, ok := s.(*quarantineSink); ok {
+			s = q.Sink
+		}
+		switch s := s.(type) {
+		case *fluentdSink:
+			go connectToFluentd(s.writer)
+		case *mqttPublisher:
+			go s.run()
+		}
+	}
+	if store != nil {
+		go store.expireLoop(1 * time.Hour)
+	}
+
+	// Process data in the background.
+	go processData(sources)
 
 	// Start the web server
-	http.HandleFunc("/_status/healthz", healthHandler)
-	http.HandleFunc("/_status/version", versionHandler)
-	http.HandleFunc("/api/devices", devicesHandler)
+	go func() {
+		http.HandleFunc("/_status/healthz", healthHandler)
+		http.HandleFunc("/_status/version", versionHandler)
+		http.HandleFunc("/_status/decode", decodeStatsHandler)
+		http.HandleFunc("/api/devices", devicesHandler)
+		http.HandleFunc("/api/devices/", deviceHandler)
+		http.HandleFunc("/api/export", exportHandler)
+		http.Handle("/api/stream", stream)
+		http.HandleFunc("/metrics", prometheusHandler)
+
+		log.Printf("Listening on %s...", *addr)
+		log.Fatal(http.ListenAndServe(*addr, nil))
+	}()
+
+	// Serve pipeline metrics on a separate listener so that they can be
+	// scraped without exposing the API.
+	if *pipelineAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", pipelineMetricsHandler)
+
+			log.Printf("Serving pipeline metrics on %s...", *pipelineAddr)
+			log.Fatal(http.ListenAndServe(*pipelineAddr, mux))
+		}()
+	}
 
-	log.Printf("Listening on %s...", *addr)
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+	log.Printf("Shutdown signal received, exiting...")
+	for _, s := range sources {
+		s.Stop()
+	}
+	sinks.Close()
+	if *statePath != "" {
+		if err := saveDeviceState(devices, *statePath); err != nil {
+			log.Printf("Could not save device state to %s: %v", *statePath, err)
+		}
+	}
+	log.Printf("Done.")
 }
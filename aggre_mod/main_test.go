@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	metrics, err = newMetricRegistry(defaultMetrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// tempDir creates a temporary directory that is removed when the test ends.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "aggre_mod-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// statusSink is a test sink that reports a status on the health endpoint.
+type statusSink struct {
+	*testSink
+	status string
+}
+
+func (s *statusSink) Status() string {
+	return s.status
+}
+
+// The status of sinks is shown whether or not the app is healthy.
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		status   string
+		wantCode int
+		wantBody string
+	}{
+		{"healthy", nil, "fluentd spool: 0 records.", http.StatusOK, "OK\nfluentd spool: 0 records."},
+		{"healthy without status", nil, "", http.StatusOK, "OK"},
+		{"unhealthy", errors.New("Not connected."), "fluentd spool: 3 records, oldest 1m0s old.", http.StatusInternalServerError,
+			"bad: Not connected.\nfluentd spool: 3 records, oldest 1m0s old.\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := newTestSink("bad")
+			bad.err = tt.err
+			sinks = newSinkSet([]Sink{bad, &statusSink{newTestSink("fluentd"), tt.status}}, 1, time.Hour)
+			defer func() {
+				sinks.Close()
+				sinks = nil
+			}()
+
+			w := httptest.NewRecorder()
+			healthHandler(w, httptest.NewRequest("GET", "/_status/healthz", nil))
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("healthHandler() = %d %q, want %d %q", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
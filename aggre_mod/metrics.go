@@ -0,0 +1,248 @@
+// metrics.go implements the registry of metrics that devices report. The
+// registry drives parsing of device data, the device state served by the
+// API and the records sent to Fluentd so that adding a new sensor only
+// requires a configuration change.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+const (
+	metricTypeFloat   = "FLOAT"
+	metricTypeInteger = "INTEGER"
+
+	metricModeNullable = "NULLABLE"
+	metricModeRequired = "REQUIRED"
+)
+
+// Metric describes a single measurement reported by devices.
+type Metric struct {
+	// Name is the field name used in device data and records.
+	Name string `json:"name"`
+	// Type is either FLOAT or INTEGER.
+	Type string `json:"type"`
+	// Unit is the unit that devices report the metric in. Values are kept
+	// in this unit and can be converted when they are read from the API if
+	// it is one of the units in units.go.
+	Unit string `json:"unit,omitempty"`
+	// Mode is NULLABLE if devices may omit the metric or REQUIRED if
+	// readings without it are rejected. The default is NULLABLE.
+	Mode string `json:"mode,omitempty"`
+	// Aliases are alternative field names that devices may use for the
+	// metric.
+	Aliases []string `json:"aliases,omitempty"`
+	// Prometheus is the name of the metric's Prometheus gauge without the
+	// weathersensors_ prefix. It defaults to the name and unit.
+	Prometheus string `json:"prometheus,omitempty"`
+	// DeviceClass is the Home Assistant device class of the metric's
+	// sensor, e.g. temperature. If empty, the sensor has no device class.
+	DeviceClass string `json:"device_class,omitempty"`
+	// Min and Max are the range of plausible values. Readings with values
+	// outside of it are quarantined.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Invalid lists values that sensors report when a read fails. Readings
+	// with these values are quarantined.
+	Invalid []float64 `json:"invalid,omitempty"`
+	// MaxRate is the largest plausible change of the metric per minute.
+	// Values that change faster are outliers. If nil, the rate of change
+	// isn't checked.
+	MaxRate *float64 `json:"max_rate,omitempty"`
+}
+
+// floatPtr returns a pointer to a float for the optional fields of metrics.
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+// The metrics known to aggre_mod when no metrics file is given.
+var defaultMetrics = []*Metric{
+	// The ranges are those of the DHT22 and BMP180 sensors. Wind and rain
+	// change too quickly to limit their rate of change.
+	{Name: "temp", Type: metricTypeFloat, Unit: "celsius", Aliases: []string{"temperature"}, Prometheus: "temperature_celsius", DeviceClass: "temperature",
+		Min: floatPtr(-40), Max: floatPtr(80), MaxRate: floatPtr(5)},
+	// The DHT22 returns -4 for both temperature and humidity when a read
+	// fails. -4 is a plausible temperature so only humidity is checked.
+	{Name: "humidity", Type: metricTypeFloat, Unit: "percent", Prometheus: "humidity_percent", DeviceClass: "humidity",
+		Min: floatPtr(0), Max: floatPtr(100), Invalid: []float64{-4}, MaxRate: floatPtr(20)},
+	{Name: "winddirection", Type: metricTypeFloat, Unit: "degrees", Prometheus: "wind_direction_degrees",
+		Min: floatPtr(0), Max: floatPtr(360)},
+	{Name: "windspeed", Type: metricTypeFloat, Unit: "m/s", Prometheus: "wind_speed_meters_per_second", DeviceClass: "wind_speed",
+		Min: floatPtr(0)},
+	{Name: "rainfall", Type: metricTypeFloat, Unit: "mm", Prometheus: "rainfall_millimeters", DeviceClass: "precipitation",
+		Min: floatPtr(0)},
+	{Name: "pressure", Type: metricTypeFloat, Unit: "hPa", Prometheus: "pressure_hpa", DeviceClass: "atmospheric_pressure",
+		Min: floatPtr(300), Max: floatPtr(1100), MaxRate: floatPtr(2)},
+}
+
+// The names of record fields that aren't metrics.
+var reservedFields = map[string]bool{
+	"deviceid":         true,
+	"record_id":        true,
+	"timestamp":        true,
+	"published_at":     true,
+	"device_timestamp": true,
+	"event":            true,
+	"quality":          true,
+	"outliers":         true,
+}
+
+// The metrics registry in use.
+var metrics *MetricRegistry
+
+// Nullable returns true if devices may omit the metric.
+func (m *Metric) Nullable() bool {
+	return m.Mode != metricModeRequired
+}
+
+// MetricRegistry holds the metrics known to aggre_mod.
+type MetricRegistry struct {
+	// Metrics in the order they were configured.
+	Metrics []*Metric
+
+	byName map[string]*Metric
+}
+
+// newMetricRegistry creates a registry from a list of metrics.
+func newMetricRegistry(metrics []*Metric) (*MetricRegistry, error) {
+	reg := &MetricRegistry{
+		Metrics: metrics,
+		byName:  make(map[string]*Metric),
+	}
+	for _, m := range metrics {
+		if m.Name == "" {
+			return nil, fmt.Errorf("metric has no name")
+		}
+		if reservedFields[m.Name] {
+			return nil, fmt.Errorf("%s is a reserved name", m.Name)
+		}
+		if m.Type == "" {
+			m.Type = metricTypeFloat
+		}
+		if m.Type != metricTypeFloat && m.Type != metricTypeInteger {
+			return nil, fmt.Errorf("metric %s has unknown type %q", m.Name, m.Type)
+		}
+		if m.Mode == "" {
+			m.Mode = metricModeNullable
+		}
+		if m.Mode != metricModeNullable && m.Mode != metricModeRequired {
+			return nil, fmt.Errorf("metric %s has unknown mode %q", m.Name, m.Mode)
+		}
+		if m.Min != nil && m.Max != nil && *m.Min > *m.Max {
+			return nil, fmt.Errorf("metric %s has a minimum greater than its maximum", m.Name)
+		}
+		if m.MaxRate != nil && *m.MaxRate <= 0 {
+			return nil, fmt.Errorf("metric %s has a max_rate that isn't positive", m.Name)
+		}
+		if _, ok := reg.byName[m.Name]; ok {
+			return nil, fmt.Errorf("metric %s is defined more than once", m.Name)
+		}
+		reg.byName[m.Name] = m
+	}
+	return reg, nil
+}
+
+// loadMetricRegistry reads the registry from a JSON file containing a list
+// of metrics. If path is empty the default metrics are used.
+func loadMetricRegistry(path string) (*MetricRegistry, error) {
+	if path == "" {
+		return newMetricRegistry(defaultMetrics)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var metrics []*Metric
+	if err := json.NewDecoder(f).Decode(&metrics); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return newMetricRegistry(metrics)
+}
+
+// Get returns the metric with the given name or nil if there is none.
+func (reg *MetricRegistry) Get(name string) *Metric {
+	return reg.byName[name]
+}
+
+// Parse reads the values of all known metrics from the fields sent by a
+// device. Values that cannot be parsed are logged and skipped. An error is
+// returned if a metric that isn't nullable is missing.
+func (reg *MetricRegistry) Parse(fields map[string]string) (map[string]float64, error) {
+	values := make(map[string]float64)
+	for _, m := range reg.Metrics {
+		str := fields[m.Name]
+		for _, alias := range m.Aliases {
+			if str != "" {
+				break
+			}
+			str = fields[alias]
+		}
+
+		if str == "" {
+			if !m.Nullable() {
+				return nil, fmt.Errorf("required metric %s is missing", m.Name)
+			}
+			continue
+		}
+
+		var val float64
+		var err error
+		if m.Type == metricTypeInteger {
+			var i int64
+			i, err = strconv.ParseInt(str, 10, 64)
+			val = float64(i)
+		} else {
+			val, err = strconv.ParseFloat(str, 64)
+		}
+		if err != nil {
+			log.Printf("Error parsing %s data: %v", m.Name, err)
+			valueErrors.Inc(m.Name)
+			continue
+		}
+		values[m.Name] = val
+	}
+	return values, nil
+}
+
+// Value returns a metric value as it should appear in records.
+func (m *Metric) Value(val float64) interface{} {
+	if m.Type == metricTypeInteger {
+		return int64(val)
+	}
+	return val
+}
+
+// bigQueryField is a field in a BigQuery table schema.
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// BigQuerySchema returns the BigQuery table schema for records.
+func (reg *MetricRegistry) BigQuerySchema() []bigQueryField {
+	fields := []bigQueryField{
+		{Name: "deviceid", Type: "STRING", Mode: "REQUIRED"},
+		{Name: "record_id", Type: "STRING", Mode: "NULLABLE"},
+	}
+	for _, m := range reg.Metrics {
+		fields = append(fields, bigQueryField{Name: m.Name, Type: m.Type, Mode: m.Mode})
+	}
+	return append(fields,
+		bigQueryField{Name: "timestamp", Type: "TIMESTAMP", Mode: "REQUIRED"},
+		bigQueryField{Name: "published_at", Type: "TIMESTAMP", Mode: "NULLABLE"},
+		bigQueryField{Name: "device_timestamp", Type: "TIMESTAMP", Mode: "NULLABLE"},
+		bigQueryField{Name: "event", Type: "STRING", Mode: "NULLABLE"},
+		bigQueryField{Name: "quality", Type: "STRING", Mode: "NULLABLE"},
+		bigQueryField{Name: "outliers", Type: "STRING", Mode: "NULLABLE"},
+	)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewMetricRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []*Metric
+		invalid bool
+	}{
+		{name: "defaults", metrics: []*Metric{{Name: "co2"}}},
+		{name: "integer required", metrics: []*Metric{{Name: "rssi", Type: metricTypeInteger, Mode: metricModeRequired}}},
+		{name: "no name", metrics: []*Metric{{Type: metricTypeFloat}}, invalid: true},
+		{name: "reserved name", metrics: []*Metric{{Name: "timestamp"}}, invalid: true},
+		{name: "unknown type", metrics: []*Metric{{Name: "co2", Type: "STRING"}}, invalid: true},
+		{name: "unknown mode", metrics: []*Metric{{Name: "co2", Mode: "REPEATED"}}, invalid: true},
+		{name: "defined twice", metrics: []*Metric{{Name: "co2"}, {Name: "co2", Type: metricTypeInteger}}, invalid: true},
+		{name: "min above max", metrics: []*Metric{{Name: "co2", Min: floatPtr(5000), Max: floatPtr(400)}}, invalid: true},
+		{name: "min equals max", metrics: []*Metric{{Name: "co2", Min: floatPtr(400), Max: floatPtr(400)}}},
+		{name: "zero max rate", metrics: []*Metric{{Name: "co2", MaxRate: floatPtr(0)}}, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, err := newMetricRegistry(tt.metrics)
+			if tt.invalid {
+				if err == nil {
+					t.Error("newMetricRegistry() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range tt.metrics {
+				if reg.Get(m.Name) != m {
+					t.Errorf("Get(%q) = %v, want %v", m.Name, reg.Get(m.Name), m)
+				}
+				if m.Type == "" || m.Mode == "" {
+					t.Errorf("metric %s has type %q and mode %q, want defaults", m.Name, m.Type, m.Mode)
+				}
+			}
+			if reg.Get("unknown") != nil {
+				t.Error("Get() returned an unknown metric")
+			}
+		})
+	}
+}
+
+func TestMetricRegistryParse(t *testing.T) {
+	reg, err := newMetricRegistry([]*Metric{
+		{Name: "temp", Aliases: []string{"temperature"}},
+		{Name: "rssi", Type: metricTypeInteger},
+		{Name: "battery", Mode: metricModeRequired},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		want    map[string]float64
+		invalid bool
+	}{
+		{
+			name:   "all metrics",
+			fields: map[string]string{"timestamp": "1500000000", "temp": "21.5", "rssi": "-60", "battery": "3.7"},
+			want:   map[string]float64{"temp": 21.5, "rssi": -60, "battery": 3.7},
+		},
+		{
+			name:   "alias",
+			fields: map[string]string{"temperature": "21.5", "battery": "3.7"},
+			want:   map[string]float64{"temp": 21.5, "battery": 3.7},
+		},
+		{
+			name:   "name is preferred to alias",
+			fields: map[string]string{"temp": "20", "temperature": "21.5", "battery": "3.7"},
+			want:   map[string]float64{"temp": 20, "battery": 3.7},
+		},
+		{
+			name:   "unparsable values are skipped",
+			fields: map[string]string{"temp": "warm", "rssi": "-60.5", "battery": "3.7"},
+			want:   map[string]float64{"battery": 3.7},
+		},
+		{
+			name:   "unknown fields are ignored",
+			fields: map[string]string{"co2": "400", "battery": "3.7"},
+			want:   map[string]float64{"battery": 3.7},
+		},
+		{name: "required metric missing", fields: map[string]string{"temp": "21.5"}, invalid: true},
+		{name: "required metric empty", fields: map[string]string{"battery": ""}, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := reg.Parse(tt.fields)
+			if tt.invalid {
+				if err == nil {
+					t.Errorf("Parse() = %v, want an error", values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(values) != fmt.Sprint(tt.want) {
+				t.Errorf("Parse() = %v, want %v", values, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMetricRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    []string
+		invalid bool
+	}{
+		{name: "metrics", json: `[{"name":"co2","unit":"ppm"},{"name":"rssi","type":"INTEGER"}]`, want: []string{"co2", "rssi"}},
+		{name: "invalid metric", json: `[{"name":"deviceid"}]`, invalid: true},
+		{name: "not a list", json: `{"name":"co2"}`, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "metrics.json")
+			if err := ioutil.WriteFile(path, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			reg, err := loadMetricRegistry(path)
+			if tt.invalid {
+				if err == nil {
+					t.Error("loadMetricRegistry() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, m := range reg.Metrics {
+				names = append(names, m.Name)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("loaded metrics %v, want %v", names, tt.want)
+			}
+		})
+	}
+
+	reg, err := loadMetricRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reg.Metrics) != len(defaultMetrics) {
+		t.Errorf("loaded %d default metrics, want %d", len(reg.Metrics), len(defaultMetrics))
+	}
+}
+
+func TestBigQuerySchema(t *testing.T) {
+	reg, err := newMetricRegistry([]*Metric{
+		{Name: "temp"},
+		{Name: "rssi", Type: metricTypeInteger, Mode: metricModeRequired},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{deviceid STRING REQUIRED} {record_id STRING NULLABLE} {temp FLOAT NULLABLE} {rssi INTEGER REQUIRED} {timestamp TIMESTAMP REQUIRED} {published_at TIMESTAMP NULLABLE} {device_timestamp TIMESTAMP NULLABLE} {event STRING NULLABLE} {quality STRING NULLABLE} {outliers STRING NULLABLE}]"
+	if got := fmt.Sprint(reg.BigQuerySchema()); got != want {
+		t.Errorf("BigQuerySchema() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+// mqtt.go adapts the Eclipse Paho MQTT client to the needs of aggre_mod: a
+// single connection to a broker over TCP or TLS that delivers received
+// messages on a channel and reports when it is lost. Reconnecting is left to
+// the callers, which resubscribe and republish their state themselves.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttDefaultAckTimeout = 10 * time.Second
+	mqttDialTimeout       = 10 * time.Second
+	// How long Close waits, in milliseconds, for outstanding work before
+	// disconnecting.
+	mqttQuiesce = 250
+)
+
+// mqttMessage is an application message sent or received over MQTT.
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+// mqttConfig holds the settings used to connect to an MQTT broker.
+type mqttConfig struct {
+	Host string
+	Port int
+	TLS  bool
+	// RootCAs verifies the broker's certificate. If nil, the system roots
+	// are used.
+	RootCAs  *x509.CertPool
+	ClientId string
+	Username string
+	Password string
+	// KeepAlive is the interval at which pings are sent to the broker. It
+	// is rounded down to whole seconds.
+	KeepAlive time.Duration
+	// AckTimeout is how long to wait for an acknowledgement or a PINGRESP.
+	// If zero, mqttDefaultAckTimeout is used.
+	AckTimeout time.Duration
+	// Will is an optional message the broker publishes on our behalf if the
+	// connection is lost.
+	Will *mqttMessage
+}
+
+// mqttClient is a connection to an MQTT broker. Received messages are
+// delivered on the Messages channel. The Done channel is closed when the
+// connection is lost, after which Err returns the reason.
+type mqttClient struct {
+	client     paho.Client
+	ackTimeout time.Duration
+
+	// mu protects err.
+	mu  sync.Mutex
+	err error
+
+	Messages chan mqttMessage
+	done     chan struct{}
+}
+
+// dialMQTT connects to the broker described by cfg and performs the MQTT
+// handshake.
+func dialMQTT(cfg mqttConfig) (*mqttClient, error) {
+	c := &mqttClient{
+		ackTimeout: cfg.AckTimeout,
+		Messages:   make(chan mqttMessage, 100),
+		done:       make(chan struct{}),
+	}
+	if c.ackTimeout <= 0 {
+		c.ackTimeout = mqttDefaultAckTimeout
+	}
+
+	scheme := "tcp"
+	if cfg.TLS {
+		scheme = "ssl"
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(scheme + "://" + net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))).
+		// MQTT 3.1.1, without falling back to 3.1 if the broker
+		// refuses the connection.
+		SetProtocolVersion(4).
+		SetClientID(cfg.ClientId).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetCleanSession(true).
+		SetKeepAlive(cfg.KeepAlive).
+		SetPingTimeout(c.ackTimeout).
+		SetConnectTimeout(mqttDialTimeout).
+		SetWriteTimeout(c.ackTimeout).
+		SetAutoReconnect(false).
+		SetDefaultPublishHandler(c.deliver).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			c.fail(err)
+		})
+	if cfg.TLS {
+		opts.SetTLSConfig(&tls.Config{ServerName: cfg.Host, RootCAs: cfg.RootCAs})
+	}
+	if cfg.Will != nil {
+		opts.SetBinaryWill(cfg.Will.Topic, cfg.Will.Payload, cfg.Will.Qos, cfg.Will.Retain)
+	}
+
+	c.client = paho.NewClient(opts)
+	if err := c.wait(c.client.Connect(), mqttDialTimeout+c.ackTimeout); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// wait waits for an operation to complete.
+func (c *mqttClient) wait(t paho.Token, timeout time.Duration) error {
+	if !t.WaitTimeout(timeout) {
+		return errors.New("timed out waiting for acknowledgement")
+	}
+	return t.Error()
+}
+
+// deliver delivers a received message on the Messages channel. Paho
+// acknowledges the message once it has been delivered.
+func (c *mqttClient) deliver(_ paho.Client, m paho.Message) {
+	select {
+	case c.Messages <- mqttMessage{
+		Topic:   m.Topic(),
+		Payload: m.Payload(),
+		Qos:     m.Qos(),
+		Retain:  m.Retained(),
+	}:
+	case <-c.done:
+	}
+}
+
+// Subscribe subscribes to the given topic filter and waits for the broker
+// to acknowledge the subscription.
+func (c *mqttClient) Subscribe(filter string, qos byte) error {
+	t := c.client.Subscribe(filter, qos, nil)
+	if err := c.wait(t, c.ackTimeout); err != nil {
+		return err
+	}
+	if code := t.(*paho.SubscribeToken).Result()[filter]; code == 0x80 {
+		return fmt.Errorf("subscription to %q refused by broker", filter)
+	}
+	return nil
+}
+
+// Publish publishes a message. Messages at QoS 1 or 2 wait for the broker's
+// acknowledgement.
+func (c *mqttClient) Publish(m mqttMessage) error {
+	return c.wait(c.client.Publish(m.Topic, m.Qos, m.Retain, m.Payload), c.ackTimeout)
+}
+
+// Done returns a channel that is closed when the connection is lost.
+func (c *mqttClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection was lost.
+func (c *mqttClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close sends a DISCONNECT packet and closes the connection.
+func (c *mqttClient) Close() error {
+	// Fail first so that a message waiting to be delivered doesn't hold up
+	// the disconnect.
+	c.fail(errors.New("connection closed"))
+	c.client.Disconnect(mqttQuiesce)
+	return nil
+}
+
+// fail records the reason the connection was lost.
+func (c *mqttClient) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
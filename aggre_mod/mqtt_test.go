@@ -0,0 +1,304 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testMQTTBroker accepts a single client connection. Packets the client
+// sends after CONNECT are delivered on the packets channel.
+type testMQTTBroker struct {
+	// The broker's address.
+	host string
+	port int
+	// accepted is closed once the client has connected. conn and connect
+	// are set then.
+	accepted chan struct{}
+	conn     net.Conn
+	connect  *packets.ConnectPacket
+	packets  chan packets.ControlPacket
+}
+
+// newTestMQTTBroker starts a test broker.
+func newTestMQTTBroker(t *testing.T) *testMQTTBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testMQTTBroker{
+		host:     "127.0.0.1",
+		port:     ln.Addr().(*net.TCPAddr).Port,
+		accepted: make(chan struct{}),
+		packets:  make(chan packets.ControlPacket, 100),
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		select {
+		case <-b.accepted:
+			b.conn.Close()
+		default:
+		}
+	})
+
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		b.conn = conn
+		b.connect, _ = p.(*packets.ConnectPacket)
+		connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		if err := connack.Write(conn); err != nil {
+			conn.Close()
+			return
+		}
+		close(b.accepted)
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			b.packets <- p
+		}
+	}()
+	return b
+}
+
+// waitAccepted waits for the client to connect.
+func (b *testMQTTBroker) waitAccepted(t *testing.T) {
+	select {
+	case <-b.accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not connect")
+	}
+}
+
+// newTestMQTTClient returns a client connected to a test broker with the
+// given settings. Host, Port and AckTimeout are filled in.
+func newTestMQTTClient(t *testing.T, cfg mqttConfig) (*mqttClient, *testMQTTBroker) {
+	b := newTestMQTTBroker(t)
+	cfg.Host = b.host
+	cfg.Port = b.port
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = time.Second
+	}
+	c, err := dialMQTT(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	b.waitAccepted(t)
+	return c, b
+}
+
+// send writes a packet to the client.
+func (b *testMQTTBroker) send(t *testing.T, p packets.ControlPacket) {
+	if err := p.Write(b.conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next waits for the client to send a packet.
+func (b *testMQTTBroker) next(t *testing.T) packets.ControlPacket {
+	select {
+	case p := <-b.packets:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("client did not send a packet")
+		return nil
+	}
+}
+
+func TestMQTTConnect(t *testing.T) {
+	_, b := newTestMQTTClient(t, mqttConfig{
+		ClientId:  "aggre_mod",
+		Username:  "user",
+		Password:  "secret",
+		KeepAlive: 30 * time.Second,
+		Will:      &mqttMessage{Topic: "a/status", Payload: []byte("offline"), Qos: 1, Retain: true},
+	})
+	c := b.connect
+	if c == nil {
+		t.Fatal("client did not send CONNECT")
+	}
+	got := []interface{}{c.ClientIdentifier, c.Username, string(c.Password), c.Keepalive, c.CleanSession,
+		c.WillFlag, c.WillTopic, string(c.WillMessage), c.WillQos, c.WillRetain}
+	want := []interface{}{"aggre_mod", "user", "secret", uint16(30), true,
+		true, "a/status", "offline", byte(1), true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CONNECT = %v, want %v", got, want)
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		packets.ReadPacket(conn)
+		connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		connack.ReturnCode = packets.ErrRefusedNotAuthorised
+		connack.Write(conn)
+	}()
+
+	c, err := dialMQTT(mqttConfig{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, AckTimeout: time.Second})
+	if err == nil {
+		c.Close()
+		t.Fatal("dialMQTT() succeeded")
+	}
+}
+
+// Messages at QoS 1 are acknowledged in both directions.
+func TestMQTTQos1(t *testing.T) {
+	c, b := newTestMQTTClient(t, mqttConfig{})
+
+	published := make(chan error, 1)
+	go func() {
+		published <- c.Publish(mqttMessage{Topic: "a/b", Payload: []byte("hi"), Qos: 1, Retain: true})
+	}()
+	p, ok := b.next(t).(*packets.PublishPacket)
+	if !ok || p.TopicName != "a/b" || string(p.Payload) != "hi" || p.Qos != 1 || !p.Retain {
+		t.Fatalf("client sent %v, want a retained QoS 1 PUBLISH to a/b", p)
+	}
+	puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	puback.MessageID = p.MessageID
+	b.send(t, puback)
+	if err := <-published; err != nil {
+		t.Errorf("Publish() = %v", err)
+	}
+
+	subscribed := make(chan error, 1)
+	go func() {
+		subscribed <- c.Subscribe("a/#", 1)
+	}()
+	s, ok := b.next(t).(*packets.SubscribePacket)
+	if !ok || !reflect.DeepEqual(s.Topics, []string{"a/#"}) || !reflect.DeepEqual(s.Qoss, []byte{1}) {
+		t.Fatalf("client sent %v, want a SUBSCRIBE to a/#", s)
+	}
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = s.MessageID
+	suback.ReturnCodes = []byte{0x80}
+	b.send(t, suback)
+	if err := <-subscribed; err == nil {
+		t.Error("refused subscription succeeded")
+	}
+
+	in := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	in.TopicName = "a/c"
+	in.Payload = []byte("ho")
+	in.Qos = 1
+	in.MessageID = 0x1234
+	b.send(t, in)
+	select {
+	case m := <-c.Messages:
+		if m.Topic != "a/c" || string(m.Payload) != "ho" || m.Qos != 1 {
+			t.Errorf("delivered %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+	if ack, ok := b.next(t).(*packets.PubackPacket); !ok || ack.MessageID != 0x1234 {
+		t.Errorf("client sent %v, want PUBACK for 0x1234", ack)
+	}
+}
+
+// A QoS 2 message is delivered and completes the PUBREC/PUBREL/PUBCOMP
+// exchange.
+func TestMQTTQos2(t *testing.T) {
+	c, b := newTestMQTTClient(t, mqttConfig{})
+
+	in := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	in.TopicName = "a/b"
+	in.Payload = []byte("hi")
+	in.Qos = 2
+	in.MessageID = 7
+	b.send(t, in)
+	select {
+	case m := <-c.Messages:
+		if m.Topic != "a/b" || string(m.Payload) != "hi" || m.Qos != 2 {
+			t.Errorf("delivered %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+	if rec, ok := b.next(t).(*packets.PubrecPacket); !ok || rec.MessageID != 7 {
+		t.Fatalf("client sent %v, want PUBREC for 7", rec)
+	}
+
+	rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	rel.MessageID = 7
+	b.send(t, rel)
+	if comp, ok := b.next(t).(*packets.PubcompPacket); !ok || comp.MessageID != 7 {
+		t.Errorf("client sent %v, want PUBCOMP for 7", comp)
+	}
+}
+
+func TestMQTTKeepAlive(t *testing.T) {
+	const ackTimeout = 500 * time.Millisecond
+	tests := []struct {
+		name   string
+		answer bool
+		lost   bool
+	}{
+		{"broker answers", true, false},
+		{"broker doesn't answer", false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c, b := newTestMQTTClient(t, mqttConfig{KeepAlive: time.Second, AckTimeout: ackTimeout})
+			pings := make(chan struct{}, 100)
+			go func() {
+				for {
+					select {
+					case p := <-b.packets:
+						if _, ok := p.(*packets.PingreqPacket); !ok {
+							t.Errorf("client sent %v, want PINGREQ", p)
+						}
+						pings <- struct{}{}
+						if tt.answer {
+							b.send(t, packets.NewControlPacket(packets.Pingresp))
+						}
+					case <-c.Done():
+						return
+					}
+				}
+			}()
+
+			select {
+			case <-c.Done():
+				if !tt.lost {
+					t.Fatalf("connection lost: %v", c.Err())
+				}
+				if c.Err() == nil {
+					t.Error("Err() = nil, want a ping timeout")
+				}
+			case <-time.After(4 * time.Second):
+				if tt.lost {
+					t.Fatal("connection not lost")
+				}
+				if len(pings) < 2 {
+					t.Errorf("%d pings sent, want at least 2", len(pings))
+				}
+			}
+		})
+	}
+}
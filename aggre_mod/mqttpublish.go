@@ -0,0 +1,331 @@
+// mqttpublish.go implements an output that republishes normalized readings
+// to an MQTT broker so that other consumers, e.g. home automation systems,
+// can use the data without talking to the Particle API. The availability of
+// each device is published to a separate topic based on its active flag, the
+// availability of the output itself is published with a last will, and Home
+// Assistant discovery configs can be published for every sensor (see
+// hadiscovery.go).
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payloads published to availability topics.
+const (
+	mqttPayloadOnline  = "online"
+	mqttPayloadOffline = "offline"
+)
+
+// mqttPublisherConfig holds the settings of the MQTT output.
+type mqttPublisherConfig struct {
+	// Topic is the template of the topics readings are published to. The
+	// placeholders {device} and {metric} are replaced with the device ID
+	// and metric name. If there is no {metric} placeholder each reading is
+	// published as a single JSON record.
+	Topic string
+	// AvailabilityTopic is the template of the topics the availability of
+	// devices is published to. The availability of the output itself is
+	// published to the topic of a device named after the MQTT client ID.
+	// If empty, availability is not published.
+	AvailabilityTopic string
+	Qos               byte
+	// Retain sets the retain flag of readings so that new subscribers
+	// receive the last values. Availability is always retained.
+	Retain bool
+	// DiscoveryPrefix is the Home Assistant discovery prefix. If empty,
+	// discovery configs are not published.
+	DiscoveryPrefix string
+	RetryWait       time.Duration
+}
+
+// mqttPublisher is a Sink that publishes readings to an MQTT broker.
+type mqttPublisher struct {
+	broker mqttConfig
+	config mqttPublisherConfig
+
+	mu     sync.Mutex
+	client *mqttClient
+	// The last known availability of each device and the devices whose
+	// availability hasn't been published yet.
+	available   map[string]bool
+	unpublished map[string]bool
+	// The sensors whose discovery config has been published on the current
+	// connection, keyed by device ID and metric name.
+	discovered map[string]bool
+
+	changed chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newMQTTPublisher creates an output that publishes to the given broker.
+// Call run to connect.
+func newMQTTPublisher(broker mqttConfig, config mqttPublisherConfig) *mqttPublisher {
+	s := &mqttPublisher{
+		broker:      broker,
+		config:      config,
+		available:   make(map[string]bool),
+		unpublished: make(map[string]bool),
+		discovered:  make(map[string]bool),
+		changed:     make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	if config.AvailabilityTopic != "" {
+		// The broker publishes that the output is offline if the
+		// connection is lost.
+		s.broker.Will = &mqttMessage{
+			Topic:   s.outputAvailabilityTopic(),
+			Payload: []byte(mqttPayloadOffline),
+			Qos:     config.Qos,
+			Retain:  true,
+		}
+	}
+	return s
+}
+
+// mqttTopicLevel replaces the characters that have a special meaning in
+// MQTT topics so that s can be used as a single topic level.
+var mqttTopicLevel = strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace
+
+// topic expands a topic template.
+func (s *mqttPublisher) topic(template, device, metric string) string {
+	return strings.NewReplacer(
+		"{device}", mqttTopicLevel(device),
+		"{metric}", mqttTopicLevel(metric),
+	).Replace(template)
+}
+
+// outputAvailabilityTopic returns the topic the availability of the output
+// itself is published to.
+func (s *mqttPublisher) outputAvailabilityTopic() string {
+	return s.topic(s.config.AvailabilityTopic, s.broker.ClientId, "")
+}
+
+// publishOutputAvailability publishes the availability of the output itself.
+func (s *mqttPublisher) publishOutputAvailability(client *mqttClient, payload string) {
+	if s.config.AvailabilityTopic == "" {
+		return
+	}
+	err := client.Publish(mqttMessage{
+		Topic:   s.outputAvailabilityTopic(),
+		Payload: []byte(payload),
+		Qos:     s.config.Qos,
+		Retain:  true,
+	})
+	if err != nil {
+		log.Printf("Could not publish availability of the mqtt output: %v", err)
+	}
+}
+
+// publishesMetrics returns true if each metric is published to its own
+// topic rather than as part of a JSON record.
+func (s *mqttPublisher) publishesMetrics() bool {
+	return strings.Contains(s.config.Topic, "{metric}")
+}
+
+func (s *mqttPublisher) Name() string {
+	return "mqtt"
+}
+
+// getClient returns the current connection or nil if there is none.
+func (s *mqttPublisher) getClient() *mqttClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// waitConnected waits until the output is connected to the broker.
+func (s *mqttPublisher) waitConnected() {
+	for s.getClient() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Write publishes the values of a reading.
+func (s *mqttPublisher) Write(r *Reading) error {
+	client := s.getClient()
+	if client == nil {
+		return errors.New("Not connected.")
+	}
+
+	// Let Home Assistant know about new devices and metrics before their
+	// values are published.
+	if err := s.discoverDevice(client, r); err != nil {
+		return err
+	}
+
+	if !s.publishesMetrics() {
+		b, err := json.Marshal(r.Record())
+		if err != nil {
+			return err
+		}
+		return client.Publish(mqttMessage{
+			Topic:   s.topic(s.config.Topic, r.DeviceId, ""),
+			Payload: b,
+			Qos:     s.config.Qos,
+			Retain:  s.config.Retain,
+		})
+	}
+
+	for _, m := range metrics.Metrics {
+		val, ok := r.Values[m.Name]
+		if !ok {
+			continue
+		}
+		err := client.Publish(mqttMessage{
+			Topic:   s.topic(s.config.Topic, r.DeviceId, m.Name),
+			Payload: []byte(formatExportValue(m.Value(val))),
+			Qos:     s.config.Qos,
+			Retain:  s.config.Retain,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mqttPublisher) Flush() error {
+	return nil
+}
+
+// Close disconnects from the broker.
+func (s *mqttPublisher) Close() error {
+	close(s.done)
+	<-s.stopped
+	return nil
+}
+
+func (s *mqttPublisher) Health() error {
+	if s.getClient() == nil {
+		return errors.New("Not connected.")
+	}
+	return nil
+}
+
+// PublishDevice publishes the availability of a device whose active state
+// changed.
+func (s *mqttPublisher) PublishDevice(d Device) {
+	if s.config.AvailabilityTopic == "" {
+		return
+	}
+
+	s.mu.Lock()
+	s.available[d.Id] = d.Active
+	s.unpublished[d.Id] = true
+	s.mu.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// publishAvailability publishes the availability of the devices whose
+// availability hasn't been published yet.
+func (s *mqttPublisher) publishAvailability(client *mqttClient) {
+	s.mu.Lock()
+	pending := make(map[string]bool)
+	for id := range s.unpublished {
+		pending[id] = s.available[id]
+	}
+	s.unpublished = make(map[string]bool)
+	s.mu.Unlock()
+
+	for id, active := range pending {
+		payload := mqttPayloadOffline
+		if active {
+			payload = mqttPayloadOnline
+		}
+		err := client.Publish(mqttMessage{
+			Topic:   s.topic(s.config.AvailabilityTopic, id, ""),
+			Payload: []byte(payload),
+			Qos:     s.config.Qos,
+			Retain:  true,
+		})
+		if err != nil {
+			log.Printf("Could not publish availability of %s: %v", id, err)
+			// Publish it again after reconnecting.
+			s.mu.Lock()
+			s.unpublished[id] = true
+			s.mu.Unlock()
+		}
+	}
+}
+
+// run continuously tries to stay connected to the broker and publishes
+// availability changes and discovery configs until the output is closed.
+func (s *mqttPublisher) run() {
+	defer close(s.stopped)
+
+	backoff := s.config.RetryWait
+	for {
+		log.Printf("Connecting to MQTT broker (%s:%d) to publish readings...", s.broker.Host, s.broker.Port)
+		client, err := dialMQTT(s.broker)
+		if err != nil {
+			log.Printf("Could not connect to MQTT broker: %v", err)
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		log.Printf("Publishing readings to MQTT broker (%s:%d)...", s.broker.Host, s.broker.Port)
+		backoff = s.config.RetryWait
+
+		// Publish discovery configs and the availability of every device
+		// again in case the broker lost its retained messages.
+		s.mu.Lock()
+		s.client = client
+		for id := range s.available {
+			s.unpublished[id] = true
+		}
+		s.mu.Unlock()
+		s.publishOutputAvailability(client, mqttPayloadOnline)
+		s.discoverAll(client)
+		s.publishAvailability(client)
+		if s.config.DiscoveryPrefix != "" {
+			if err := client.Subscribe(s.statusTopic(), 0); err != nil {
+				log.Printf("Could not subscribe to MQTT topic %s: %v", s.statusTopic(), err)
+			}
+		}
+
+	loop:
+		for {
+			select {
+			case <-s.changed:
+				s.publishAvailability(client)
+			case m := <-client.Messages:
+				// Home Assistant forgets discovered sensors that aren't
+				// retained when it restarts.
+				if m.Topic == s.statusTopic() && string(m.Payload) == haPayloadOnline {
+					log.Printf("Home Assistant is online, publishing discovery configs...")
+					s.discoverAll(client)
+				}
+			case <-client.Done():
+				log.Printf("Lost connection to MQTT broker: %v", client.Err())
+				break loop
+			case <-s.done:
+				// The will isn't published when the connection is closed
+				// cleanly.
+				s.publishOutputAvailability(client, mqttPayloadOffline)
+				client.Close()
+				return
+			}
+		}
+
+		s.mu.Lock()
+		s.client = nil
+		s.mu.Unlock()
+	}
+}
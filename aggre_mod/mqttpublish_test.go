@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func TestMQTTPublisherTopic(t *testing.T) {
+	tests := []struct {
+		template       string
+		device, metric string
+		want           string
+		metrics        bool
+	}{
+		{"weathersensors/{device}/{metric}", "abc123", "temp", "weathersensors/abc123/temp", true},
+		{"weathersensors/{device}", "abc123", "", "weathersensors/abc123", false},
+		{"weathersensors/{device}/{metric}", "a/b+c#", "temp", "weathersensors/a_b_c_/temp", true},
+		{"{metric}/{device}/{device}", "abc", "temp", "temp/abc/abc", true},
+		{"weathersensors/all", "abc", "", "weathersensors/all", false},
+	}
+	for _, tt := range tests {
+		s := newMQTTPublisher(mqttConfig{}, mqttPublisherConfig{Topic: tt.template})
+		if got := s.topic(tt.template, tt.device, tt.metric); got != tt.want {
+			t.Errorf("topic(%q, %q, %q) = %s, want %s", tt.template, tt.device, tt.metric, got, tt.want)
+		}
+		if s.publishesMetrics() != tt.metrics {
+			t.Errorf("publishesMetrics() for %q = %v, want %v", tt.template, s.publishesMetrics(), tt.metrics)
+		}
+	}
+}
+
+// The availability of devices follows their active flag and is published
+// retained, once per change.
+func TestMQTTPublisherAvailability(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		changes []Device
+		want    []string
+	}{
+		{
+			name:    "no availability topic",
+			changes: []Device{{Id: "a", Active: true}},
+			want:    []string{},
+		},
+		{
+			name:    "online and offline",
+			topic:   "weathersensors/{device}/availability",
+			changes: []Device{{Id: "a", Active: true}, {Id: "b/1", Active: false}},
+			want:    []string{"weathersensors/a/availability online", "weathersensors/b_1/availability offline"},
+		},
+		{
+			name:    "latest state",
+			topic:   "weathersensors/{device}/availability",
+			changes: []Device{{Id: "a", Active: true}, {Id: "a", Active: false}},
+			want:    []string{"weathersensors/a/availability offline"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, broker := newTestMQTTClient(t, mqttConfig{})
+			s := newMQTTPublisher(mqttConfig{}, mqttPublisherConfig{Topic: "weathersensors/{device}/{metric}", AvailabilityTopic: tt.topic})
+			for _, d := range tt.changes {
+				s.PublishDevice(d)
+			}
+			go s.publishAvailability(client)
+
+			got := []string{}
+			for range tt.want {
+				select {
+				case p := <-broker.packets:
+					m, ok := p.(*packets.PublishPacket)
+					if !ok {
+						t.Fatalf("client sent %v, want PUBLISH", p)
+					}
+					if !m.Retain {
+						t.Errorf("availability of %s isn't retained", m.TopicName)
+					}
+					got = append(got, m.TopicName+" "+string(m.Payload))
+				case <-time.After(time.Second):
+					t.Fatalf("published %v, want %v", got, tt.want)
+				}
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("published %v, want %v", got, tt.want)
+			}
+
+			// Nothing is published again until the state changes.
+			s.publishAvailability(client)
+			select {
+			case p := <-broker.packets:
+				t.Errorf("published %v again", p)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+// The output's own availability is online while it is connected. The
+// broker publishes its will if the connection is lost and the output
+// publishes offline itself when it is closed.
+func TestMQTTPublisherOutputAvailability(t *testing.T) {
+	const topic = "weathersensors/aggre_mod-publisher/availability"
+	b := newTestMQTTBroker(t)
+	s := newMQTTPublisher(
+		mqttConfig{Host: b.host, Port: b.port, ClientId: "aggre_mod-publisher", AckTimeout: time.Second},
+		mqttPublisherConfig{Topic: "weathersensors/{device}/{metric}", AvailabilityTopic: "weathersensors/{device}/availability", Qos: 1, RetryWait: time.Second},
+	)
+	go s.run()
+	b.waitAccepted(t)
+
+	c := b.connect
+	if !c.WillFlag || c.WillTopic != topic || string(c.WillMessage) != mqttPayloadOffline || !c.WillRetain || c.WillQos != 1 {
+		t.Errorf("will is %v %s %q retained %v QoS %d, want a retained QoS 1 %s to %s",
+			c.WillFlag, c.WillTopic, c.WillMessage, c.WillRetain, c.WillQos, mqttPayloadOffline, topic)
+	}
+
+	expectPublish := func(payload string) {
+		t.Helper()
+		p, ok := b.next(t).(*packets.PublishPacket)
+		if !ok || p.TopicName != topic || string(p.Payload) != payload || !p.Retain {
+			t.Fatalf("client sent %v, want a retained %s to %s", p, payload, topic)
+		}
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		b.send(t, puback)
+	}
+	expectPublish(mqttPayloadOnline)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+	expectPublish(mqttPayloadOffline)
+	if _, ok := b.next(t).(*packets.DisconnectPacket); !ok {
+		t.Error("client did not disconnect")
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+}
+
+func TestMQTTPublisherNoWill(t *testing.T) {
+	s := newMQTTPublisher(mqttConfig{ClientId: "aggre_mod-publisher"}, mqttPublisherConfig{Topic: "weathersensors/{device}/{metric}"})
+	if s.broker.Will != nil {
+		t.Errorf("will is %+v without an availability topic", s.broker.Will)
+	}
+}
@@ -0,0 +1,151 @@
+// mqttsource.go implements a Source that receives climate data published by
+// devices to an MQTT broker.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mqttSource subscribes to a topic filter on an MQTT broker.
+type mqttSource struct {
+	sourceState
+
+	config    mqttConfig
+	topic     string
+	retryWait time.Duration
+}
+
+// newMQTTSource creates a new source that subscribes to the given topic
+// filter.
+func newMQTTSource(config mqttConfig, topic string, retryWait time.Duration) *mqttSource {
+	return &mqttSource{
+		sourceState: newSourceState(),
+		config:      config,
+		topic:       topic,
+		retryWait:   retryWait,
+	}
+}
+
+func (s *mqttSource) Name() string {
+	return "mqtt"
+}
+
+func (s *mqttSource) Start(readings chan<- *Reading, errs chan<- error) {
+	go s.run(readings, errs)
+}
+
+func (s *mqttSource) Stop() {
+	s.stop()
+}
+
+// connect continuously tries to connect to the MQTT broker and subscribe to
+// the configured topic. It returns nil if the source was stopped.
+func (s *mqttSource) connect() *mqttClient {
+	backoff := s.retryWait
+
+	for {
+		log.Printf("Connecting to MQTT broker (%s:%d)...", s.config.Host, s.config.Port)
+		client, err := dialMQTT(s.config)
+		if err == nil {
+			err = client.Subscribe(s.topic, 1)
+			if err != nil {
+				client.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("Could not subscribe to MQTT topic %s: %v", s.topic, err)
+			if !s.wait(backoff) {
+				return nil
+			}
+			backoff *= 2
+		} else {
+			log.Printf("Subscribed to MQTT topic %s...", s.topic)
+			return client
+		}
+	}
+}
+
+// run reads messages from the MQTT broker until the source is stopped.
+func (s *mqttSource) run(readings chan<- *Reading, errs chan<- error) {
+	for connected := false; ; connected = true {
+		client := s.connect()
+		if client == nil {
+			return
+		}
+		if connected {
+			reconnects.Inc(s.Name())
+		}
+		s.setConnected(true)
+
+	loop:
+		for {
+			select {
+			case m := <-client.Messages:
+				eventsReceived.Inc(s.Name())
+				r, err := parseClimateMessage(m)
+				if err != nil {
+					decodeErrors.Inc(s.Name(), decodeErrorReason(err))
+					errs <- fmt.Errorf("%s: %v", s.Name(), err)
+					continue
+				}
+				r.Source = s.Name()
+				readings <- r
+			case <-client.Done():
+				errs <- fmt.Errorf("%s: lost connection to MQTT broker: %v", s.Name(), client.Err())
+				break loop
+			case <-s.done:
+				client.Close()
+				s.setConnected(false)
+				return
+			}
+		}
+
+		s.setConnected(false)
+	}
+}
+
+// parseClimateMessage parses the JSON climate data published by a device,
+// e.g. {"location": "living", "timestamp": 1500000000, "temperature": 21.5}.
+func parseClimateMessage(m mqttMessage) (*Reading, error) {
+	data, err := decodeJSON(string(m.Payload))
+	if err != nil {
+		return nil, &decodeError{formatJSON, fmt.Errorf("Could not parse MQTT message on %s: %v", m.Topic, err)}
+	}
+
+	// Devices are identified by their location. Fall back to
+	// the location in the topic (home/<location>/climate).
+	deviceId := data["location"]
+	if deviceId == "" {
+		parts := strings.Split(m.Topic, "/")
+		if len(parts) == 3 {
+			deviceId = parts[1]
+		}
+	}
+	if deviceId == "" {
+		return nil, &decodeError{reasonDevice, fmt.Errorf("MQTT message on %s has no location", m.Topic)}
+	}
+	if err := checkDeviceId(deviceId); err != nil {
+		return nil, &decodeError{reasonDevice, fmt.Errorf("MQTT message on %s: %v", m.Topic, err)}
+	}
+
+	timestamp, err := strconv.ParseInt(data["timestamp"], 10, 64)
+	if err != nil {
+		return nil, &decodeError{reasonTimestamp, fmt.Errorf("Error reading timestamp of MQTT message on %s: %v", m.Topic, err)}
+	}
+
+	values, err := metrics.Parse(data)
+	if err != nil {
+		return nil, &decodeError{reasonMetric, err}
+	}
+
+	return &Reading{
+		DeviceId:  deviceId,
+		Timestamp: timestamp,
+		Values:    values,
+	}, nil
+}
@@ -0,0 +1,89 @@
+// ndjsonsink.go implements sinks that write readings as newline delimited
+// JSON records to stdout or to rotating files.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// ndjsonSink writes each reading's record as a line of JSON.
+type ndjsonSink struct {
+	name string
+
+	mu sync.Mutex
+	w  *bufio.Writer
+	// close closes the underlying writer. It may be nil.
+	close func() error
+}
+
+// newStdoutSink creates a sink that writes records to stdout.
+func newStdoutSink() *ndjsonSink {
+	return &ndjsonSink{
+		name: "stdout",
+		w:    bufio.NewWriter(os.Stdout),
+	}
+}
+
+// newFileSink creates a sink that writes records to NDJSON files in dir
+// whose names start with prefix. A new file is started when the current one
+// exceeds maxBytes and the oldest files are removed when there are more than
+// maxFiles.
+func newFileSink(dir, prefix string, maxBytes int64, maxFiles int) (*ndjsonSink, error) {
+	f, err := newRotatingFile(dir, prefix, ".ndjson", maxBytes, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonSink{
+		name:  "file",
+		w:     bufio.NewWriter(f),
+		close: f.Close,
+	}, nil
+}
+
+func (s *ndjsonSink) Name() string {
+	return s.name
+}
+
+// Write buffers a record. Each record is written to the underlying writer
+// in a single call so that records are never split across rotated files.
+func (s *ndjsonSink) Write(r *Reading) error {
+	b, err := json.Marshal(r.Record())
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w.Available() < len(b) {
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err = s.w.Write(b)
+	return err
+}
+
+func (s *ndjsonSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+func (s *ndjsonSink) Close() error {
+	err := s.Flush()
+	if s.close != nil {
+		if cerr := s.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *ndjsonSink) Health() error {
+	return nil
+}
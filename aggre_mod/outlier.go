@@ -0,0 +1,220 @@
+// outlier.go implements filtering of values that pass validation but are
+// implausible given the recent values of the same device and metric, e.g. a
+// single reading 40°C hotter than the ones around it. A short window of
+// recent values is kept for each device and metric. A value is an outlier if
+// it changes faster than the metric's max_rate or deviates from the median
+// of the window by more than a number of median absolute deviations (MADs).
+// Outliers are either flagged in records or dropped.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The names of the outlier rules.
+const (
+	outlierRuleRate = "rate"
+	outlierRuleMAD  = "mad"
+)
+
+// The actions taken on outliers.
+const (
+	outlierActionFlag = "flag"
+	outlierActionDrop = "drop"
+)
+
+// The quality of records with outliers.
+const qualityOutlier = "outlier"
+
+// The number of values the window must hold before the MAD rule is checked.
+const outlierMinSamples = 3
+
+// madScale and meanADScale scale the median and mean absolute deviations so
+// that they estimate the standard deviation of normally distributed values.
+const (
+	madScale    = 1.4826
+	meanADScale = 1.2533
+)
+
+// outlierSample is a value in the window of a series.
+type outlierSample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// outlierSeries holds the recent values of a device's metric.
+type outlierSeries struct {
+	// The most recent values that weren't outliers, oldest first.
+	window []outlierSample
+	// The outliers since the last value that wasn't one.
+	outliers []outlierSample
+}
+
+// outlierFilter flags or drops the outliers of readings.
+type outlierFilter struct {
+	size int
+	mads float64
+	drop bool
+
+	mu     sync.Mutex
+	series map[string]*outlierSeries
+}
+
+// The outlier filter in use. It is nil if outliers aren't filtered.
+var outliers *outlierFilter
+
+// newOutlierFilter creates a filter that keeps windows of size values. If
+// mads is zero only the rate of change is checked. action is either flag or
+// drop.
+func newOutlierFilter(size, mads int, action string) (*outlierFilter, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("the window size must be at least 1")
+	}
+	if action != outlierActionFlag && action != outlierActionDrop {
+		return nil, fmt.Errorf("unknown outlier action %q", action)
+	}
+	return &outlierFilter{
+		size:   size,
+		mads:   float64(mads),
+		drop:   action == outlierActionDrop,
+		series: make(map[string]*outlierSeries),
+	}, nil
+}
+
+// median returns the median of values. values is sorted in place.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// check returns the rule that a new value of the series fails or an empty
+// string if it isn't an outlier.
+func (f *outlierFilter) check(s *outlierSeries, m *Metric, sample outlierSample) string {
+	if len(s.window) == 0 {
+		return ""
+	}
+
+	if m.MaxRate != nil {
+		last := s.window[len(s.window)-1]
+		// Readings with the same timestamp are treated as a second apart.
+		seconds := math.Max(float64(sample.Timestamp-last.Timestamp), 1)
+		if math.Abs(sample.Value-last.Value)*60/seconds > *m.MaxRate {
+			return outlierRuleRate
+		}
+	}
+
+	if f.mads > 0 && len(s.window) >= outlierMinSamples {
+		values := make([]float64, len(s.window))
+		for i, w := range s.window {
+			values[i] = w.Value
+		}
+		med := median(values)
+		sum := 0.0
+		for i := range values {
+			values[i] = math.Abs(values[i] - med)
+			sum += values[i]
+		}
+		// If most values are equal the MAD is zero and every change would
+		// be an outlier so the mean absolute deviation is used instead.
+		mad := median(values) * madScale
+		if mad == 0 {
+			mad = sum / float64(len(values)) * meanADScale
+		}
+		if mad > 0 && math.Abs(sample.Value-med) > f.mads*mad {
+			return outlierRuleMAD
+		}
+	}
+	return ""
+}
+
+// add adds a value to the series and returns the rule it fails, if any.
+func (f *outlierFilter) add(s *outlierSeries, m *Metric, sample outlierSample) string {
+	rule := f.check(s, m, sample)
+	if rule == "" {
+		s.window = append(s.window, sample)
+		if len(s.window) > f.size {
+			s.window = s.window[len(s.window)-f.size:]
+		}
+		s.outliers = nil
+		return ""
+	}
+
+	// If more than half a window of values in a row are outliers the
+	// metric has most likely changed for real, e.g. because a sensor was
+	// moved, so the window starts over with the new values.
+	s.outliers = append(s.outliers, sample)
+	if len(s.outliers) > f.size/2 {
+		s.window = s.outliers
+		if len(s.window) > f.size {
+			s.window = s.window[len(s.window)-f.size:]
+		}
+		s.outliers = nil
+	}
+	return rule
+}
+
+// Check checks the values of a reading and sets its outliers. If outliers
+// are dropped they are removed from the reading's values. It returns false
+// if every value of the reading was dropped.
+func (f *outlierFilter) Check(r *Reading) bool {
+	if f == nil {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dropped := false
+	for _, m := range metrics.Metrics {
+		val, ok := r.Values[m.Name]
+		if !ok {
+			continue
+		}
+		key := labelKey([]string{r.DeviceId, m.Name})
+		s, ok := f.series[key]
+		if !ok {
+			s = &outlierSeries{}
+			f.series[key] = s
+		}
+		rule := f.add(s, m, outlierSample{Timestamp: r.Timestamp, Value: val})
+		if rule == "" {
+			continue
+		}
+
+		outlierValues.Inc(m.Name, rule)
+		if r.Outliers == nil {
+			r.Outliers = make(map[string]string)
+		}
+		r.Outliers[m.Name] = rule
+		if f.drop {
+			delete(r.Values, m.Name)
+			dropped = true
+		}
+	}
+	return !dropped || len(r.Values) > 0
+}
+
+// annotateOutliers adds the quality of a reading and its outliers, e.g.
+// "temp:rate,humidity:mad", to a record if it has any.
+func (r *Reading) annotateOutliers(record map[string]interface{}) {
+	if len(r.Outliers) == 0 {
+		return
+	}
+	list := []string{}
+	for _, m := range metrics.Metrics {
+		if rule, ok := r.Outliers[m.Name]; ok {
+			list = append(list, m.Name+":"+rule)
+		}
+	}
+	record["quality"] = qualityOutlier
+	record["outliers"] = strings.Join(list, ",")
+}
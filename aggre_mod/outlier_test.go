@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// window returns a window of values taken a minute apart, ending at time 0.
+func window(values ...float64) []outlierSample {
+	samples := make([]outlierSample, len(values))
+	for i, v := range values {
+		samples[i] = outlierSample{Timestamp: int64(i-len(values)+1) * 60, Value: v}
+	}
+	return samples
+}
+
+func TestOutlierRules(t *testing.T) {
+	rate := 5.0
+	tests := []struct {
+		name    string
+		maxRate *float64
+		window  []outlierSample
+		sample  outlierSample
+		want    string
+	}{
+		{"empty window", &rate, nil, outlierSample{60, 100}, ""},
+		{"within rate", &rate, window(20), outlierSample{60, 24}, ""},
+		{"faster than rate", &rate, window(20), outlierSample{60, 26}, outlierRuleRate},
+		{"rate over two minutes", &rate, window(20), outlierSample{120, 29}, ""},
+		{"same timestamp", &rate, window(20), outlierSample{0, 20.05}, ""},
+		{"same timestamp too fast", &rate, window(20), outlierSample{0, 21}, outlierRuleRate},
+		{"no rate", nil, window(20), outlierSample{60, 26}, ""},
+		{"too few samples for MAD", nil, window(20, 21), outlierSample{60, 60}, ""},
+		{"within MADs", nil, window(20, 21, 22, 21, 20), outlierSample{60, 23}, ""},
+		{"beyond MADs", nil, window(20, 21, 22, 21, 20), outlierSample{60, 40}, outlierRuleMAD},
+		{"beyond MADs below", nil, window(20, 21, 22, 21, 20), outlierSample{60, 0}, outlierRuleMAD},
+		{"flat window uses mean deviation", nil, window(40, 40, 40, 40, 41), outlierSample{60, 90}, outlierRuleMAD},
+		{"flat window small change", nil, window(40, 40, 40, 40, 41), outlierSample{60, 41}, ""},
+		{"constant window", nil, window(40, 40, 40), outlierSample{60, 90}, ""},
+	}
+	f, err := newOutlierFilter(10, 5, outlierActionFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Metric{Name: "temp", MaxRate: tt.maxRate}
+			s := &outlierSeries{window: tt.window}
+			if got := f.check(s, m, tt.sample); got != tt.want {
+				t.Errorf("check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutlierWindowRestarts(t *testing.T) {
+	f, err := newOutlierFilter(4, 0, outlierActionFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Metric{Name: "temp", MaxRate: floatPtr(5)}
+	s := &outlierSeries{window: window(20)}
+
+	// After more than half a window of outliers in a row the new level is
+	// accepted.
+	want := []string{outlierRuleRate, outlierRuleRate, outlierRuleRate, ""}
+	for i, rule := range want {
+		sample := outlierSample{int64(i+1) * 60, 40 + float64(i)}
+		if got := f.add(s, m, sample); got != rule {
+			t.Errorf("value %d: add() = %q, want %q", i, got, rule)
+		}
+	}
+}
+
+func TestOutlierCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		values map[string]float64
+		want   bool
+		// The values left and the outliers found.
+		left     string
+		outliers string
+	}{
+		{"no outliers", outlierActionFlag, map[string]float64{"temp": 20, "humidity": 40}, true, "map[humidity:40 temp:20]", "map[]"},
+		{"flagged", outlierActionFlag, map[string]float64{"temp": 40, "humidity": 40}, true, "map[humidity:40 temp:40]", "map[temp:rate]"},
+		{"one dropped", outlierActionDrop, map[string]float64{"temp": 40, "humidity": 40}, true, "map[humidity:40]", "map[temp:rate]"},
+		{"all dropped", outlierActionDrop, map[string]float64{"temp": 40}, false, "map[]", "map[temp:rate]"},
+		{"no values", outlierActionDrop, map[string]float64{}, true, "map[]", "map[]"},
+		{"unknown metric", outlierActionDrop, map[string]float64{"foo": 1}, true, "map[foo:1]", "map[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newOutlierFilter(10, 5, tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := &Reading{DeviceId: "dev", Timestamp: 0, Values: map[string]float64{"temp": 20, "humidity": 40}}
+			if !f.Check(first) {
+				t.Fatal("first reading dropped")
+			}
+
+			r := &Reading{DeviceId: "dev", Timestamp: 60, Values: tt.values}
+			if got := f.Check(r); got != tt.want {
+				t.Errorf("Check() = %v, want %v", got, tt.want)
+			}
+			if got := fmt.Sprint(r.Values); got != tt.left {
+				t.Errorf("values = %s, want %s", got, tt.left)
+			}
+			outliers := r.Outliers
+			if outliers == nil {
+				outliers = map[string]string{}
+			}
+			if got := fmt.Sprint(outliers); got != tt.outliers {
+				t.Errorf("outliers = %s, want %s", got, tt.outliers)
+			}
+		})
+	}
+}
+
+func TestOutlierCheckNil(t *testing.T) {
+	var f *outlierFilter
+	r := &Reading{DeviceId: "dev", Values: map[string]float64{"temp": 1000}}
+	if !f.Check(r) || len(r.Outliers) != 0 {
+		t.Error("a nil filter found outliers")
+	}
+}
@@ -0,0 +1,234 @@
+// particle.go implements a Source that receives data published by devices
+// via the Particle pub/sub API.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/donovanhide/eventsource"
+)
+
+const PARTICLE_API_URL = "https://api.particle.io/v1"
+
+// Data message from the Particle API
+type Message struct {
+	Id          string `json:"coreid"`
+	Data        string `json:"data"`
+	Ttl         string `json:"ttl"`
+	PublishedAt string `json:"published_at"`
+	// Event is the name of the event. It isn't part of the message data
+	// sent by the Particle API and is filled in from the SSE event.
+	Event string `json:"event,omitempty"`
+}
+
+// particleEventsURL returns the URL of the event stream for events whose
+// name starts with the given prefix. If product is not empty the stream for
+// the product's devices is returned, otherwise the stream for the devices
+// owned by the user is returned.
+func particleEventsURL(apiURL, product, prefix string) string {
+	apiURL = strings.TrimRight(apiURL, "/")
+	if product != "" {
+		return fmt.Sprintf("%s/products/%s/events/%s", apiURL, url.PathEscape(product), prefix)
+	}
+	return fmt.Sprintf("%s/devices/events/%s", apiURL, prefix)
+}
+
+// particleSource subscribes to a Particle API event stream.
+type particleSource struct {
+	sourceState
+
+	accessToken string
+	url         string
+	prefix      string
+	product     string
+	retryWait   time.Duration
+
+	// capture is used to save raw messages for replay. It is nil if
+	// capture mode is off.
+	capture *captureWriter
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newParticleSource creates a new source for the Particle API that
+// subscribes to events whose name starts with prefix. If product is not empty
+// the product's event stream is used. If capture is not nil every message
+// received is saved with it.
+func newParticleSource(accessToken, apiURL, product, prefix string, retryWait time.Duration, capture *captureWriter) *particleSource {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &particleSource{
+		sourceState: newSourceState(),
+		accessToken: accessToken,
+		url:         particleEventsURL(apiURL, product, prefix),
+		prefix:      prefix,
+		product:     product,
+		retryWait:   retryWait,
+		capture:     capture,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+func (s *particleSource) Name() string {
+	if s.product != "" {
+		return "particle/products/" + s.product + "/" + s.prefix
+	}
+	return "particle/" + s.prefix
+}
+
+func (s *particleSource) Start(readings chan<- *Reading, errs chan<- error) {
+	go s.run(readings, errs)
+}
+
+func (s *particleSource) Stop() {
+	s.cancel()
+	s.stop()
+}
+
+// connect continuously tries to connect to the Particle API. It returns nil
+// if the source was stopped.
+func (s *particleSource) connect() *eventsource.Stream {
+	backoff := s.retryWait
+
+	for {
+		req, err := http.NewRequest("GET", s.url, nil)
+		if err != nil {
+			log.Fatalf("Could not create request: %v", err)
+		}
+
+		req = req.WithContext(s.ctx)
+		req.Header.Set("Authorization", "Bearer "+s.accessToken)
+		log.Printf("Connecting to Particle API (%s)...", s.Name())
+		stream, err := eventsource.SubscribeWithRequest("", req)
+		if err != nil {
+			log.Printf("Could not subscribe to Particle API stream %s: %v", s.Name(), err)
+			if !s.wait(backoff) {
+				return nil
+			}
+			backoff *= 2
+		} else {
+			log.Printf("Connected to Particle API (%s)...", s.Name())
+			return stream
+		}
+	}
+}
+
+// run reads events from the Particle API until the source is stopped.
+func (s *particleSource) run(readings chan<- *Reading, errs chan<- error) {
+	// The stream object reconnects with exponential backoff.
+	stream := s.connect()
+	if stream == nil {
+		return
+	}
+	s.setConnected(true)
+	defer s.setConnected(false)
+
+	for {
+		select {
+		case event := <-stream.Events:
+			// The stream reconnects silently after an error so the first
+			// event since then, even a keep-alive, means it is back.
+			s.setConnected(true)
+			// The particle API often sends newlines.
+			// Perhaps as a keep-alive mechanism.
+			if event.Data() == "" {
+				continue
+			}
+			eventsReceived.Inc(s.Name())
+			m, err := parseParticleEvent(event.Data())
+			if err != nil {
+				decodeErrors.Inc(s.Name(), decodeErrorReason(err))
+				errs <- fmt.Errorf("%s: %v", s.Name(), err)
+				continue
+			}
+			m.Event = event.Event()
+			if m.Event == "" {
+				m.Event = s.prefix
+			}
+			if s.capture != nil {
+				if err := s.capture.Write(m); err != nil {
+					errs <- fmt.Errorf("%s: could not capture message: %v", s.Name(), err)
+				}
+			}
+			r, err := parseParticleMessage(m)
+			if err != nil {
+				decodeErrors.Inc(s.Name(), decodeErrorReason(err))
+				errs <- fmt.Errorf("%s: %v", s.Name(), err)
+				continue
+			}
+			r.Source = s.Name()
+			readings <- r
+		case err := <-stream.Errors:
+			// The stream reconnects after each error.
+			s.setConnected(false)
+			reconnects.Inc(s.Name())
+			errs <- fmt.Errorf("%s: stream error: %v", s.Name(), err)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// parseParticleEvent parses the JSON data of a Particle API event.
+func parseParticleEvent(jsonData string) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal([]byte(jsonData), &m); err != nil {
+		return nil, &decodeError{reasonMessage, fmt.Errorf("Could not parse message data: %v", err)}
+	}
+	return &m, nil
+}
+
+// parseParticleMessage parses the LTSV or JSON data sent by the device in a
+// Particle API message.
+func parseParticleMessage(m *Message) (*Reading, error) {
+	if err := checkDeviceId(m.Id); err != nil {
+		return nil, &decodeError{reasonDevice, err}
+	}
+
+	format, data, err := decodePayload(m.Data)
+	if err == nil {
+		log.Printf("Got %s data: %v", format, data)
+	} else {
+		err = &decodeError{format, err}
+	}
+
+	var timestamp int64
+	if err == nil {
+		timestamp, err = strconv.ParseInt(data["timestamp"], 10, 64)
+		if err != nil {
+			err = &decodeError{reasonTimestamp, fmt.Errorf("Error reading timestamp: %v", err)}
+		}
+	}
+	payloadStats.record(format, err)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := metrics.Parse(data)
+	if err != nil {
+		return nil, &decodeError{reasonMetric, err}
+	}
+
+	r := &Reading{
+		DeviceId:  m.Id,
+		Event:     m.Event,
+		Timestamp: timestamp,
+		Values:    values,
+	}
+	// The publish time is only used to detect skewed device clocks so
+	// messages without one are still processed.
+	if publishedAt, err := time.Parse(time.RFC3339, m.PublishedAt); err == nil {
+		r.PublishedAt = publishedAt.Unix()
+	}
+	return r, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParticleEventsURL(t *testing.T) {
+	tests := []struct {
+		apiURL, product, prefix string
+		want                    string
+	}{
+		{"https://api.particle.io/v1", "", "weatherdata", "https://api.particle.io/v1/devices/events/weatherdata"},
+		{"https://api.particle.io/v1/", "", "weatherdata", "https://api.particle.io/v1/devices/events/weatherdata"},
+		{"https://api.particle.io/v1", "", "", "https://api.particle.io/v1/devices/events/"},
+		{"https://api.particle.io/v1", "1234", "weatherdata", "https://api.particle.io/v1/products/1234/events/weatherdata"},
+		{"https://api.particle.io/v1", "my product", "diag", "https://api.particle.io/v1/products/my%20product/events/diag"},
+		{"http://localhost:8080", "", "weatherdata2", "http://localhost:8080/devices/events/weatherdata2"},
+	}
+	for _, tt := range tests {
+		if got := particleEventsURL(tt.apiURL, tt.product, tt.prefix); got != tt.want {
+			t.Errorf("particleEventsURL(%q, %q, %q) = %s, want %s", tt.apiURL, tt.product, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// The source is disconnected from a stream error until the next event.
+func TestParticleSourceConnected(t *testing.T) {
+	closeFirst := make(chan struct{})
+	release := make(chan struct{})
+	var conns int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		wait := closeFirst
+		if atomic.AddInt32(&conns, 1) > 1 {
+			wait = release
+		} else {
+			// Reconnect quickly after the first connection is closed.
+			fmt.Fprint(w, "retry: 10\n")
+			fmt.Fprintf(w, "data: %s\n\n", `{"coreid":"dev","data":"timestamp:1500000000\ttemp:21.5"}`)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-wait:
+		case <-r.Context().Done():
+			return
+		}
+		if wait == release {
+			fmt.Fprintf(w, "data: %s\n\n", `{"coreid":"dev","data":"timestamp:1500000060\ttemp:21.5"}`)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	s := newParticleSource("token", srv.URL, "", "weatherdata", time.Millisecond, nil)
+	readings := make(chan *Reading)
+	errs := make(chan error, 10)
+	s.Start(readings, errs)
+	defer s.Stop()
+
+	next := func() {
+		t.Helper()
+		select {
+		case <-readings:
+		case err := <-errs:
+			t.Fatalf("got error %v, want a reading", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reading received")
+		}
+	}
+
+	next()
+	if !s.Connected() {
+		t.Error("not connected after an event")
+	}
+
+	close(closeFirst)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream error")
+	}
+	if s.Connected() {
+		t.Error("connected after a stream error")
+	}
+
+	close(release)
+	next()
+	if !s.Connected() {
+		t.Error("not connected after reconnecting")
+	}
+}
@@ -0,0 +1,250 @@
+// pipeline.go implements operational metrics for each stage of the pipeline
+// (sources, decoding and sinks) and serves them in the Prometheus text
+// exposition format on a separate listener.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pipelineNamespace = "aggre_mod"
+
+// pipelineCollector is a metric that can write itself in the exposition
+// format.
+type pipelineCollector interface {
+	write(w io.Writer)
+}
+
+// pipelineCollectors are the metrics served on the pipeline metrics
+// endpoint in the order they are written.
+var pipelineCollectors []pipelineCollector
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// labelPairs returns label names and values as alternating pairs for
+// promLabels.
+func labelPairs(names []string, key string) []string {
+	values := strings.Split(key, "\x00")
+	pairs := make([]string, 0, len(names)*2)
+	for i, name := range names {
+		pairs = append(pairs, name, values[i])
+	}
+	return pairs
+}
+
+// sortedKeys returns the keys of a map in sorted order so that series are
+// always written in the same order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// counterVec is a set of counters partitioned by labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newCounterVec creates a counter and registers it with the pipeline
+// metrics.
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   pipelineNamespace + "_" + name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	pipelineCollectors = append(pipelineCollectors, c)
+	return c
+}
+
+// Inc increments the counter with the given label values.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelKey(labelValues)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writePromHeader(w, c.name, "counter", c.help)
+	keys := make(map[string]bool)
+	for k := range c.values {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		writePromSample(w, c.name, promLabels(labelPairs(c.labels, k)...), c.values[k])
+	}
+}
+
+// histogram holds the observations of a single histogram series.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a set of histograms partitioned by labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+// newHistogramVec creates a histogram with the given bucket upper bounds and
+// registers it with the pipeline metrics.
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    pipelineNamespace + "_" + name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	pipelineCollectors = append(pipelineCollectors, h)
+	return h
+}
+
+// Observe adds an observation to the histogram with the given label values.
+func (h *histogramVec) Observe(val float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := labelKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if val <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += val
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writePromHeader(w, h.name, "histogram", h.help)
+	keys := make(map[string]bool)
+	for k := range h.series {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		s := h.series[k]
+		pairs := labelPairs(h.labels, k)
+		for i, le := range h.buckets {
+			writePromSample(w, h.name+"_bucket", promLabels(append(pairs, "le", fmt.Sprint(le))...), float64(s.counts[i]))
+		}
+		writePromSample(w, h.name+"_bucket", promLabels(append(pairs, "le", "+Inf")...), float64(s.count))
+		writePromSample(w, h.name+"_sum", promLabels(pairs...), s.sum)
+		writePromSample(w, h.name+"_count", promLabels(pairs...), float64(s.count))
+	}
+}
+
+// gaugeFuncVec is a set of gauges whose values are read when the metrics
+// are served.
+type gaugeFuncVec struct {
+	name  string
+	help  string
+	label string
+
+	mu    sync.Mutex
+	funcs map[string]func() float64
+}
+
+// newGaugeFuncVec creates a gauge with a single label and registers it with
+// the pipeline metrics.
+func newGaugeFuncVec(name, help, label string) *gaugeFuncVec {
+	g := &gaugeFuncVec{
+		name:  pipelineNamespace + "_" + name,
+		help:  help,
+		label: label,
+		funcs: make(map[string]func() float64),
+	}
+	pipelineCollectors = append(pipelineCollectors, g)
+	return g
+}
+
+// Set sets the function that returns the value of the gauge with the given
+// label value.
+func (g *gaugeFuncVec) Set(labelValue string, f func() float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.funcs[labelValue] = f
+}
+
+func (g *gaugeFuncVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writePromHeader(w, g.name, "gauge", g.help)
+	keys := make(map[string]bool)
+	for k := range g.funcs {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		writePromSample(w, g.name, promLabels(g.label, k), g.funcs[k]())
+	}
+}
+
+// The pipeline metrics.
+var (
+	eventsReceived = newCounterVec("events_received_total", "The number of events received by each source.", "source")
+	decodeErrors   = newCounterVec("decode_errors_total", "The number of events that could not be decoded by source and reason.", "source", "reason")
+	valueErrors    = newCounterVec("value_errors_total", "The number of metric values that could not be parsed and were skipped.", "metric")
+	quarantined    = newCounterVec("readings_quarantined_total", "The number of readings quarantined by the metric and rule they failed.", "metric", "rule")
+	outlierValues  = newCounterVec("outlier_values_total", "The number of values found to be outliers by the metric and rule they failed.", "metric", "rule")
+	duplicates     = newCounterVec("duplicates_suppressed_total", "The number of readings dropped because they were received before, by source.", "source")
+	skewedReadings = newCounterVec("clock_skewed_total", "The number of readings from devices with a skewed clock by source and the action taken.", "source", "action")
+	reconnects     = newCounterVec("source_reconnects_total", "The number of times each source reconnected after losing its connection.", "source")
+
+	recordsPosted  = newCounterVec("records_posted_total", "The number of records written to each sink.", "sink")
+	recordsFailed  = newCounterVec("records_failed_total", "The number of records that could not be written to each sink.", "sink")
+	recordsDropped = newCounterVec("records_dropped_total", "The number of records dropped because a sink's queue was full.", "sink")
+	sinkLatency    = newHistogramVec("sink_write_duration_seconds", "The time taken to write a record to each sink.",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "sink")
+
+	queueLength = newGaugeFuncVec("queue_length", "The number of readings waiting in each queue.", "queue")
+)
+
+// observeSince records the time elapsed since start in a histogram.
+func observeSince(h *histogramVec, start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Serves the pipeline metrics.
+func pipelineMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range pipelineCollectors {
+		c.write(w)
+	}
+}
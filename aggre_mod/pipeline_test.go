@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := &counterVec{name: "aggre_mod_test_total", help: "Test.", labels: []string{"source", "reason"}, values: make(map[string]float64)}
+	c.Inc("particle/weatherdata", "json")
+	c.Inc("mqtt", "ltsv")
+	c.Inc("particle/weatherdata", "json")
+	c.Inc("mqtt", "")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	want := `# HELP aggre_mod_test_total Test.
+# TYPE aggre_mod_test_total counter
+aggre_mod_test_total{source="mqtt"} 1
+aggre_mod_test_total{source="mqtt",reason="ltsv"} 1
+aggre_mod_test_total{source="particle/weatherdata",reason="json"} 2
+`
+	if buf.String() != want {
+		t.Errorf("write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := &histogramVec{name: "aggre_mod_test_seconds", help: "Test.", labels: []string{"sink"}, buckets: []float64{0.1, 1}, series: make(map[string]*histogram)}
+	for _, val := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(val, "fluentd")
+	}
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP aggre_mod_test_seconds Test.
+# TYPE aggre_mod_test_seconds histogram
+aggre_mod_test_seconds_bucket{sink="fluentd",le="0.1"} 2
+aggre_mod_test_seconds_bucket{sink="fluentd",le="1"} 3
+aggre_mod_test_seconds_bucket{sink="fluentd",le="+Inf"} 4
+aggre_mod_test_seconds_sum{sink="fluentd"} 2.65
+aggre_mod_test_seconds_count{sink="fluentd"} 4
+`
+	if buf.String() != want {
+		t.Errorf("write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestGaugeFuncVec(t *testing.T) {
+	g := &gaugeFuncVec{name: "aggre_mod_test_length", help: "Test.", label: "queue", funcs: make(map[string]func() float64)}
+	length := 3
+	g.Set("sink/stdout", func() float64 { return float64(length) })
+	g.Set("devices", func() float64 { return 0 })
+	length = 5
+
+	var buf bytes.Buffer
+	g.write(&buf)
+	want := `# HELP aggre_mod_test_length Test.
+# TYPE aggre_mod_test_length gauge
+aggre_mod_test_length{queue="devices"} 0
+aggre_mod_test_length{queue="sink/stdout"} 5
+`
+	if buf.String() != want {
+		t.Errorf("write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestDecodeErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&decodeError{formatJSON, errors.New("bad json")}, formatJSON},
+		{&decodeError{reasonTimestamp, errors.New("bad timestamp")}, reasonTimestamp},
+		{errors.New("other"), "other"},
+	}
+	for _, tt := range tests {
+		if got := decodeErrorReason(tt.err); got != tt.want {
+			t.Errorf("decodeErrorReason(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
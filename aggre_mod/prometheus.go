@@ -0,0 +1,137 @@
+// prometheus.go implements the /metrics endpoint that exposes the latest
+// readings of each device as Prometheus gauges in the text exposition
+// format.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const promNamespace = "weathersensors"
+
+// promName returns the name of a metric's gauge.
+func promName(m *Metric) string {
+	if m.Prometheus != "" {
+		return promNamespace + "_" + m.Prometheus
+	}
+	name := m.Name
+	if m.Unit != "" {
+		name += "_" + strings.Replace(m.Unit, "/", "_per_", -1)
+	}
+	return promNamespace + "_" + sanitizePromName(strings.ToLower(name))
+}
+
+// sanitizePromName replaces characters that are not allowed in metric names
+// with underscores.
+func sanitizePromName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// promLabels formats label name and value pairs, e.g. {deviceid="abc"}.
+// Labels with empty values are left out.
+func promLabels(pairs ...string) string {
+	var b bytes.Buffer
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(promEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "{" + b.String() + "}"
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// writePromHeader writes the HELP and TYPE lines of a metric.
+func writePromHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// writePromSample writes a single sample. Whole numbers such as timestamps
+// are written without an exponent.
+func writePromSample(w io.Writer, name, labels string, val float64) {
+	s := strconv.FormatFloat(val, 'g', -1, 64)
+	if val == math.Trunc(val) && math.Abs(val) < 1e15 {
+		s = strconv.FormatInt(int64(val), 10)
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, s)
+}
+
+// deviceLabels returns the labels identifying a device.
+func deviceLabels(d Device) string {
+	return promLabels("deviceid", d.Id, "name", d.Name, "location", d.Location)
+}
+
+// writeDeviceMetrics writes gauges for the latest readings of the given
+// devices. Devices not seen for longer than horizon are left out so that
+// their series go stale. If horizon is zero all devices are included.
+func writeDeviceMetrics(w io.Writer, snapshot []Device, horizon time.Duration) {
+	now := time.Now().Unix()
+	list := []Device{}
+	for _, d := range snapshot {
+		if horizon > 0 && now-d.LastSeen > int64(horizon/time.Second) {
+			continue
+		}
+		list = append(list, d)
+	}
+
+	for _, m := range metrics.Metrics {
+		name := promName(m)
+		help := "Latest " + m.Name + " reading"
+		if m.Unit != "" {
+			help += " in " + m.Unit
+		}
+		writePromHeader(w, name, "gauge", help+".")
+		for _, d := range list {
+			if val, ok := d.Values[m.Name]; ok {
+				writePromSample(w, name, deviceLabels(d), val)
+			}
+		}
+	}
+
+	name := promNamespace + "_last_seen_timestamp_seconds"
+	writePromHeader(w, name, "gauge", "The time the device last sent a reading in seconds since the epoch.")
+	for _, d := range list {
+		writePromSample(w, name, deviceLabels(d), float64(d.LastSeen))
+	}
+
+	name = promNamespace + "_device_active"
+	writePromHeader(w, name, "gauge", "Whether the device has sent a reading within the device timeout.")
+	for _, d := range list {
+		active := 0.0
+		if d.Active {
+			active = 1
+		}
+		writePromSample(w, name, deviceLabels(d), active)
+	}
+}
+
+// Serves the latest readings of each device as Prometheus gauges.
+func prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeDeviceMetrics(w, devices.Snapshot(), time.Duration(*promHorizon)*time.Second)
+}
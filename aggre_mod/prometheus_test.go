@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromName(t *testing.T) {
+	tests := []struct {
+		m    *Metric
+		want string
+	}{
+		{&Metric{Name: "temp", Unit: "celsius", Prometheus: "temperature_celsius"}, "weathersensors_temperature_celsius"},
+		{&Metric{Name: "co2", Unit: "ppm"}, "weathersensors_co2_ppm"},
+		{&Metric{Name: "windspeed", Unit: "m/s"}, "weathersensors_windspeed_m_per_s"},
+		{&Metric{Name: "rssi"}, "weathersensors_rssi"},
+		{&Metric{Name: "PM2.5", Unit: "µg/m3"}, "weathersensors_pm2_5___g_per_m3"},
+	}
+	for _, tt := range tests {
+		if got := promName(tt.m); got != tt.want {
+			t.Errorf("promName(%s) = %s, want %s", tt.m.Name, got, tt.want)
+		}
+	}
+}
+
+func TestPromLabels(t *testing.T) {
+	tests := []struct {
+		pairs []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"deviceid", ""}, ""},
+		{[]string{"deviceid", "abc", "name", ""}, `{deviceid="abc"}`},
+		{[]string{"deviceid", "abc", "name", "Living room"}, `{deviceid="abc",name="Living room"}`},
+		{[]string{"name", `say "hi"\` + "\n"}, `{name="say \"hi\"\\\n"}`},
+	}
+	for _, tt := range tests {
+		if got := promLabels(tt.pairs...); got != tt.want {
+			t.Errorf("promLabels(%q) = %s, want %s", tt.pairs, got, tt.want)
+		}
+	}
+}
+
+// Devices that haven't been seen within the horizon are left out so that
+// their series go stale.
+func TestWriteDeviceMetricsHorizon(t *testing.T) {
+	now := time.Now().Unix()
+	snapshot := []Device{
+		{Id: "recent", DeviceInfo: DeviceInfo{Name: "Garden"}, Values: map[string]float64{"temp": 21.5}, LastSeen: now - 60, Active: true},
+		{Id: "gone", Values: map[string]float64{"temp": 18, "humidity": 40}, LastSeen: now - 2*60*60},
+	}
+	tests := []struct {
+		name    string
+		horizon time.Duration
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "no horizon",
+			horizon: 0,
+			want: []string{
+				`weathersensors_temperature_celsius{deviceid="recent",name="Garden"} 21.5`,
+				`weathersensors_temperature_celsius{deviceid="gone"} 18`,
+				`weathersensors_humidity_percent{deviceid="gone"} 40`,
+				`weathersensors_device_active{deviceid="recent",name="Garden"} 1`,
+				`weathersensors_device_active{deviceid="gone"} 0`,
+			},
+		},
+		{
+			name:    "within horizon",
+			horizon: time.Hour,
+			want: []string{
+				`weathersensors_temperature_celsius{deviceid="recent",name="Garden"} 21.5`,
+				`weathersensors_last_seen_timestamp_seconds{deviceid="recent",name="Garden"} `,
+				"# TYPE weathersensors_humidity_percent gauge",
+			},
+			notWant: []string{`deviceid="gone"`},
+		},
+		{
+			name:    "all stale",
+			horizon: 30 * time.Second,
+			want:    []string{"# TYPE weathersensors_temperature_celsius gauge"},
+			notWant: []string{`deviceid="recent"`, `deviceid="gone"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeDeviceMetrics(&buf, snapshot, tt.horizon)
+			out := buf.String()
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("output doesn't contain %q:\n%s", s, out)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(out, s) {
+					t.Errorf("output contains %q:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
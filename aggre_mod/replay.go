@@ -0,0 +1,219 @@
+// replay.go implements the replay command which reads Particle API messages
+// saved in capture mode and sends them through the same decoding and
+// Fluentd posting code as live data. It is used to backfill data that was
+// dropped because of a bug.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayFilter selects which captured messages are replayed.
+type replayFilter struct {
+	devices map[string]bool
+	from    time.Time
+	to      time.Time
+}
+
+// match returns true if the message should be replayed.
+func (f *replayFilter) match(m *Message, publishedAt time.Time) bool {
+	if len(f.devices) > 0 && !f.devices[m.Id] {
+		return false
+	}
+	if !f.from.IsZero() && publishedAt.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && !publishedAt.Before(f.to) {
+		return false
+	}
+	return true
+}
+
+// parseTimeFlag parses an RFC 3339 time given on the command line. An empty
+// value results in the zero time.
+func parseTimeFlag(name, val string) time.Time {
+	if val == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		log.Fatalf("Invalid value for -%s: %v", name, err)
+	}
+	return t
+}
+
+// replayCommand runs the replay command with the given arguments.
+func replayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	devices := fs.String("device", "", "A comma separated list of device IDs to replay. If empty, all devices are replayed.")
+	from := fs.String("from", "", "Only replay messages published at or after this time (RFC 3339).")
+	to := fs.String("to", "", "Only replay messages published before this time (RFC 3339).")
+	speed := fs.Float64("speed", 0, "The replay speed relative to the original publish times, e.g. 1 for real time or 60 for one minute per second. If 0, messages are replayed as fast as possible.")
+	dryRun := fs.Bool("dry-run", false, "Decode messages without writing them to the outputs.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] replay [replay flags] FILE...\n\nReplay flags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		if *captureDir == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var err error
+		files, err = captureFiles(*captureDir)
+		if err != nil {
+			log.Fatal("Could not list capture files: ", err)
+		}
+	}
+
+	filter := &replayFilter{
+		devices: make(map[string]bool),
+		from:    parseTimeFlag("from", *from),
+		to:      parseTimeFlag("to", *to),
+	}
+	for _, id := range strings.Split(*devices, ",") {
+		if id != "" {
+			filter.devices[id] = true
+		}
+	}
+
+	r := &replayer{
+		filter: filter,
+		speed:  *speed,
+		dryRun: *dryRun,
+	}
+	if !r.dryRun {
+		r.sinks = createSinks()
+		for _, s := range r.sinks {
+			if q, ok := s.(*quarantineSink); ok {
+				s = q.Sink
+			}
+			// Wait for Fluentd and the MQTT broker so that records aren't
+			// dropped.
+			switch s := s.(type) {
+			case *fluentdSink:
+				connectToFluentd(s.writer)
+			case *mqttPublisher:
+				go s.run()
+				s.waitConnected()
+			}
+		}
+	}
+
+	for _, name := range files {
+		if err := r.replayFile(name); err != nil {
+			log.Fatalf("Error replaying %s: %v", name, err)
+		}
+	}
+
+	for _, s := range r.sinks {
+		if err := s.Close(); err != nil {
+			log.Printf("Could not close %s: %v", s.Name(), err)
+		}
+	}
+
+	log.Printf("Replayed %d messages (%d skipped, %d errors).", r.replayed, r.skipped, r.errors)
+}
+
+// replayer replays captured messages.
+type replayer struct {
+	filter *replayFilter
+	speed  float64
+	dryRun bool
+	sinks  []Sink
+
+	// The publish time of the last message replayed.
+	last time.Time
+
+	replayed int
+	skipped  int
+	errors   int
+}
+
+// replayFile replays the messages in a single capture file.
+func (r *replayer) replayFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	log.Printf("Replaying %s...", name)
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var m Message
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			log.Printf("Could not parse captured message: %v", err)
+			r.errors++
+			continue
+		}
+		r.replay(&m)
+	}
+	return s.Err()
+}
+
+// replay sends a single captured message through the decoding pipeline.
+func (r *replayer) replay(m *Message) {
+	publishedAt, err := time.Parse(time.RFC3339, m.PublishedAt)
+	if err != nil {
+		log.Printf("Could not parse publish time of captured message: %v", err)
+		r.errors++
+		return
+	}
+
+	if !r.filter.match(m, publishedAt) {
+		r.skipped++
+		return
+	}
+
+	// Wait between messages to reproduce the original timing.
+	if r.speed > 0 && !r.last.IsZero() && publishedAt.After(r.last) {
+		time.Sleep(time.Duration(float64(publishedAt.Sub(r.last)) / r.speed))
+	}
+	r.last = publishedAt
+
+	reading, err := parseParticleMessage(m)
+	if err != nil {
+		log.Printf("Error decoding message from %s published at %s: %v", m.Id, m.PublishedAt, err)
+		r.errors++
+		return
+	}
+	reading.Source = "replay"
+
+	// Captures include the events the Particle API resent after reconnects,
+	// which are dropped as duplicates.
+	if !processReading(reading) {
+		r.skipped++
+		return
+	}
+
+	if r.dryRun {
+		log.Printf("Decoded data (%s): %v", reading.DeviceId, reading.Record())
+	} else {
+		for _, s := range r.sinks {
+			if !sinkAccepts(s, reading) {
+				continue
+			}
+			if err := s.Write(reading); err != nil {
+				log.Printf("Could not send data from %s to %s: %v", reading.DeviceId, s.Name(), err)
+			}
+		}
+	}
+	r.replayed++
+}
@@ -0,0 +1,319 @@
+// rollup.go implements rollups of stored readings at 1 minute, 1 hour and 1
+// day resolution. For each device, metric and time bucket the minimum,
+// maximum, mean, count and first and last values are kept.
+//
+// Buckets are aggregated in memory and appended to the store once they are
+// complete. Readings that arrive late, e.g. when replaying, are written as
+// further partial buckets which are merged with the earlier ones when
+// rollups are queried.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rollupResolution is a rollup bucket size.
+type rollupResolution struct {
+	Name string
+	// The layout of the time in the names of files holding the rollups.
+	// Each file holds the buckets starting in one UTC period.
+	fileLayout string
+	// start returns the start of the bucket holding t.
+	start func(t time.Time) time.Time
+	// next returns the start of the bucket following the one starting at t.
+	next func(t time.Time) time.Time
+}
+
+// rollupResolutions are the resolutions that rollups are kept at.
+var rollupResolutions = []*rollupResolution{
+	{
+		Name:       "1m",
+		fileLayout: "2006-01-02",
+		start:      func(t time.Time) time.Time { return t.Truncate(time.Minute) },
+		next:       func(t time.Time) time.Time { return t.Add(time.Minute) },
+	},
+	{
+		Name:       "1h",
+		fileLayout: "2006-01",
+		// The minutes are subtracted rather than using time.Date so that
+		// the hour repeated when DST ends has a bucket of its own.
+		start: func(t time.Time) time.Time {
+			return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		},
+		next: func(t time.Time) time.Time { return t.Add(time.Hour) },
+	},
+	{
+		Name:       "1d",
+		fileLayout: "2006",
+		start: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+		next: func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	},
+}
+
+// getRollupResolution returns the resolution with the given name or nil if
+// there is none.
+func getRollupResolution(name string) *rollupResolution {
+	for _, res := range rollupResolutions {
+		if res.Name == name {
+			return res
+		}
+	}
+	return nil
+}
+
+// rollupStat is the aggregate of a metric's values in a bucket.
+type rollupStat struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Sum    float64 `json:"sum"`
+	Count  int64   `json:"n"`
+	First  float64 `json:"f"`
+	FirstT int64   `json:"ft"`
+	Last   float64 `json:"l"`
+	LastT  int64   `json:"lt"`
+}
+
+// add adds a value taken at the given time.
+func (s *rollupStat) add(val float64, t int64) {
+	s.merge(&rollupStat{Min: val, Max: val, Sum: val, Count: 1, First: val, FirstT: t, Last: val, LastT: t})
+}
+
+// merge merges another aggregate of the same bucket.
+func (s *rollupStat) merge(o *rollupStat) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 {
+		*s = *o
+		return
+	}
+	if o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Sum += o.Sum
+	s.Count += o.Count
+	if o.FirstT < s.FirstT {
+		s.First, s.FirstT = o.First, o.FirstT
+	}
+	if o.LastT >= s.LastT {
+		s.Last, s.LastT = o.Last, o.LastT
+	}
+}
+
+// rollupBucket holds the aggregates of all metrics in a bucket.
+type rollupBucket struct {
+	Start int64                  `json:"s"`
+	Stats map[string]*rollupStat `json:"v"`
+}
+
+// merge merges another partial bucket with the same start.
+func (b *rollupBucket) merge(o *rollupBucket) {
+	for name, stat := range o.Stats {
+		s, ok := b.Stats[name]
+		if !ok {
+			s = &rollupStat{}
+			b.Stats[name] = s
+		}
+		s.merge(stat)
+	}
+}
+
+// rollupKey identifies an in-memory bucket.
+type rollupKey struct {
+	device string
+	res    *rollupResolution
+	start  int64
+}
+
+// rollups maintains the rollups of a store.
+type rollups struct {
+	store *readingStore
+	loc   *time.Location
+
+	mu sync.Mutex
+	// Buckets that haven't been written yet.
+	pending map[rollupKey]*rollupBucket
+}
+
+func newRollups(store *readingStore, loc *time.Location) *rollups {
+	return &rollups{
+		store:   store,
+		loc:     loc,
+		pending: make(map[rollupKey]*rollupBucket),
+	}
+}
+
+// path returns the path of the file holding a device's buckets of the given
+// resolution that start at t.
+func (ru *rollups) path(id string, res *rollupResolution, t time.Time) string {
+	return filepath.Join(ru.store.deviceDir(id), fmt.Sprintf("rollup-%s-%s.ndjson", res.Name, t.UTC().Format(res.fileLayout)))
+}
+
+// Add adds a reading to the buckets of every resolution.
+func (ru *rollups) Add(r *Reading) {
+	// Outliers would skew the averages.
+	values := make(map[string]float64)
+	for name, val := range r.Values {
+		if _, ok := r.Outliers[name]; !ok {
+			values[name] = val
+		}
+	}
+	if len(values) == 0 {
+		return
+	}
+	t := time.Unix(r.Timestamp, 0).In(ru.loc)
+
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+
+	for _, res := range rollupResolutions {
+		key := rollupKey{r.DeviceId, res, res.start(t).Unix()}
+		b, ok := ru.pending[key]
+		if !ok {
+			b = &rollupBucket{Start: key.start, Stats: make(map[string]*rollupStat)}
+			ru.pending[key] = b
+		}
+		for name, val := range values {
+			s, ok := b.Stats[name]
+			if !ok {
+				s = &rollupStat{}
+				b.Stats[name] = s
+			}
+			s.add(val, r.Timestamp)
+		}
+	}
+}
+
+// Flush writes buckets that ended before the given time. If all is true
+// every pending bucket is written.
+func (ru *rollups) Flush(now time.Time, all bool) error {
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+
+	// Write buckets in order so that files are mostly sorted.
+	keys := []rollupKey{}
+	for key := range ru.pending {
+		end := key.res.next(time.Unix(key.start, 0).In(ru.loc))
+		if all || !end.After(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].start < keys[j].start })
+
+	ru.store.mu.Lock()
+	defer ru.store.mu.Unlock()
+
+	for _, key := range keys {
+		b, err := json.Marshal(ru.pending[key])
+		if err != nil {
+			return err
+		}
+		if err := appendLine(ru.path(key.device, key.res, time.Unix(key.start, 0)), b); err != nil {
+			return err
+		}
+		delete(ru.pending, key)
+	}
+	return nil
+}
+
+// readFile reads the buckets in a rollup file that start in [from, to) and
+// merges them into buckets.
+func (ru *rollups) readFile(path string, from, to int64, buckets map[int64]*rollupBucket) error {
+	ru.store.mu.RLock()
+	data, err := ioutil.ReadFile(path)
+	ru.store.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			// An incomplete line that is still being written.
+			break
+		}
+		line := data[:i]
+		data = data[i+1:]
+
+		var b rollupBucket
+		if err := json.Unmarshal(line, &b); err != nil {
+			log.Printf("Skipping corrupt rollup in %s: %v", path, err)
+			continue
+		}
+		if b.Start < from || b.Start >= to {
+			continue
+		}
+		mergeBucket(buckets, &b)
+	}
+	return nil
+}
+
+// mergeBucket merges a partial bucket into the buckets with the same start.
+func mergeBucket(buckets map[int64]*rollupBucket, b *rollupBucket) {
+	existing, ok := buckets[b.Start]
+	if !ok {
+		existing = &rollupBucket{Start: b.Start, Stats: make(map[string]*rollupStat)}
+		buckets[b.Start] = existing
+	}
+	existing.merge(b)
+}
+
+// Query returns the buckets of a device at the given resolution that
+// overlap [from, to), oldest first. Buckets that are still being aggregated
+// are included.
+func (ru *rollups) Query(id string, res *rollupResolution, from, to int64) ([]*rollupBucket, error) {
+	buckets := make(map[int64]*rollupBucket)
+	from = res.start(time.Unix(from, 0).In(ru.loc)).Unix()
+
+	// Read the existing files that may hold buckets in the range. Files are
+	// named after the UTC period their buckets start in.
+	files, err := filepath.Glob(filepath.Join(ru.store.deviceDir(id), fmt.Sprintf("rollup-%s-*.ndjson", res.Name)))
+	if err != nil {
+		return nil, err
+	}
+	first, _ := time.Parse(res.fileLayout, time.Unix(from, 0).UTC().Format(res.fileLayout))
+	for _, path := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "rollup-"+res.Name+"-"), ".ndjson")
+		period, err := time.Parse(res.fileLayout, name)
+		if err != nil || period.Before(first) || period.Unix() >= to {
+			continue
+		}
+		if err := ru.readFile(path, from, to, buckets); err != nil {
+			return nil, err
+		}
+	}
+
+	ru.mu.Lock()
+	for key, b := range ru.pending {
+		if key.device == id && key.res == res && key.start >= from && key.start < to {
+			mergeBucket(buckets, b)
+		}
+	}
+	ru.mu.Unlock()
+
+	list := make([]*rollupBucket, 0, len(buckets))
+	for _, b := range buckets {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start < list[j].Start })
+	return list, nil
+}
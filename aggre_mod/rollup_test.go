@@ -0,0 +1,159 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// loadLocation loads a time zone or fails the test.
+func loadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestRollupBuckets(t *testing.T) {
+	tests := []struct {
+		name  string
+		res   string
+		loc   string
+		t     string
+		start string
+		next  string
+	}{
+		{"minute", "1m", "UTC", "2026-03-10T10:45:30Z", "2026-03-10T10:45:00Z", "2026-03-10T10:46:00Z"},
+		{"hour", "1h", "UTC", "2026-03-10T10:45:30Z", "2026-03-10T10:00:00Z", "2026-03-10T11:00:00Z"},
+		{"day", "1d", "UTC", "2026-03-10T10:45:30Z", "2026-03-10T00:00:00Z", "2026-03-11T00:00:00Z"},
+		{"half hour offset hour", "1h", "Asia/Kolkata", "2026-03-10T10:45:30+05:30", "2026-03-10T10:00:00+05:30", "2026-03-10T11:00:00+05:30"},
+		{"half hour offset day", "1d", "Asia/Kolkata", "2026-03-10T01:00:00+05:30", "2026-03-10T00:00:00+05:30", "2026-03-11T00:00:00+05:30"},
+		{"day before DST starts", "1d", "America/New_York", "2026-03-07T23:59:59-05:00", "2026-03-07T00:00:00-05:00", "2026-03-08T00:00:00-05:00"},
+		{"day DST starts", "1d", "America/New_York", "2026-03-08T12:00:00-04:00", "2026-03-08T00:00:00-05:00", "2026-03-09T00:00:00-04:00"},
+		{"day DST ends", "1d", "America/New_York", "2026-11-01T23:00:00-05:00", "2026-11-01T00:00:00-04:00", "2026-11-02T00:00:00-05:00"},
+		{"hour after DST starts", "1h", "America/New_York", "2026-03-08T03:30:00-04:00", "2026-03-08T03:00:00-04:00", "2026-03-08T04:00:00-04:00"},
+		{"first repeated hour", "1h", "America/New_York", "2026-11-01T01:30:00-04:00", "2026-11-01T01:00:00-04:00", "2026-11-01T01:00:00-05:00"},
+		{"second repeated hour", "1h", "America/New_York", "2026-11-01T01:30:00-05:00", "2026-11-01T01:00:00-05:00", "2026-11-01T02:00:00-05:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := getRollupResolution(tt.res)
+			loc := loadLocation(t, tt.loc)
+			ts, err := time.Parse(time.RFC3339, tt.t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := res.start(ts.In(loc))
+			if got := start.Format(time.RFC3339); !start.Equal(mustParseTime(t, tt.start)) {
+				t.Errorf("start(%s) = %s, want %s", tt.t, got, tt.start)
+			}
+			next := res.next(start)
+			if got := next.Format(time.RFC3339); !next.Equal(mustParseTime(t, tt.next)) {
+				t.Errorf("next(%s) = %s, want %s", start.Format(time.RFC3339), got, tt.next)
+			}
+		})
+	}
+}
+
+// mustParseTime parses an RFC 3339 time or fails the test.
+func mustParseTime(t *testing.T, s string) time.Time {
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// Rollups of the day DST ends in New York have 25 hourly buckets and one
+// daily bucket holding all of them, whether they were flushed to files or are
+// still pending.
+func TestRollupQueryAcrossDST(t *testing.T) {
+	loc := loadLocation(t, "America/New_York")
+	dayStart := mustParseTime(t, "2026-11-01T00:00:00-04:00")
+	dayEnd := mustParseTime(t, "2026-11-02T00:00:00-05:00")
+
+	tests := []struct {
+		name    string
+		flush   bool
+		res     string
+		from    int64
+		to      int64
+		buckets int
+		count   int64
+	}{
+		{"hours", true, "1h", dayStart.Unix(), dayEnd.Unix(), 25, 2},
+		{"day", true, "1d", dayStart.Unix(), dayEnd.Unix(), 1, 50},
+		{"pending day", false, "1d", dayStart.Unix(), dayEnd.Unix(), 1, 50},
+		{"from the epoch", true, "1m", 0, dayEnd.Unix(), 50, 1},
+		{"before the data", true, "1h", 0, dayStart.Unix(), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := openStore(tempDir(t), 0, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Two readings every hour.
+			for ts := dayStart; ts.Before(dayEnd); ts = ts.Add(30 * time.Minute) {
+				s.rollups.Add(&Reading{DeviceId: "dev", Timestamp: ts.Unix(), Values: map[string]float64{"temp": 20}})
+			}
+			if tt.flush {
+				if err := s.rollups.Flush(dayEnd.Add(48*time.Hour), true); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			buckets, err := s.rollups.Query("dev", getRollupResolution(tt.res), tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buckets) != tt.buckets {
+				t.Fatalf("got %d buckets, want %d", len(buckets), tt.buckets)
+			}
+			for _, b := range buckets {
+				if n := b.Stats["temp"].Count; n != tt.count {
+					t.Errorf("bucket at %s has %d values, want %d", time.Unix(b.Start, 0).In(loc).Format(time.RFC3339), n, tt.count)
+				}
+			}
+		})
+	}
+}
+
+func TestRollupsSkipOutliers(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   map[string]float64
+		outliers map[string]string
+		want     map[string]int64
+	}{
+		{"no outliers", map[string]float64{"temp": 20, "humidity": 40}, nil, map[string]int64{"temp": 1, "humidity": 1}},
+		{"one outlier", map[string]float64{"temp": 20, "humidity": 40}, map[string]string{"temp": outlierRuleRate}, map[string]int64{"humidity": 1}},
+		{"only outliers", map[string]float64{"temp": 20}, map[string]string{"temp": outlierRuleMAD}, nil},
+		{"no values", map[string]float64{}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ru := newRollups(nil, time.UTC)
+			ru.Add(&Reading{DeviceId: "dev", Timestamp: 1792195200, Values: tt.values, Outliers: tt.outliers})
+			if tt.want == nil {
+				if len(ru.pending) != 0 {
+					t.Errorf("%d buckets created, want none", len(ru.pending))
+				}
+				return
+			}
+			if len(ru.pending) != len(rollupResolutions) {
+				t.Fatalf("%d buckets created, want %d", len(ru.pending), len(rollupResolutions))
+			}
+			for key, b := range ru.pending {
+				if len(b.Stats) != len(tt.want) {
+					t.Errorf("%s bucket has %d metrics, want %d", key.res.Name, len(b.Stats), len(tt.want))
+				}
+				for name, n := range tt.want {
+					if s, ok := b.Stats[name]; !ok || s.Count != n {
+						t.Errorf("%s bucket is missing %s", key.res.Name, name)
+					}
+				}
+			}
+		})
+	}
+}
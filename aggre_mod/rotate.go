@@ -0,0 +1,132 @@
+// rotate.go implements writing to a series of files in a directory that are
+// rotated by size.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatingFile appends data to files named <prefix>-<time><ext> in a
+// directory. A new file is started when the current one would exceed
+// maxBytes and the oldest files are removed when there are more than
+// maxFiles.
+type rotatingFile struct {
+	dir      string
+	prefix   string
+	ext      string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// newRotatingFile creates a rotating file in the given directory, creating
+// it if necessary. If maxFiles is zero old files are never removed.
+func newRotatingFile(dir, prefix, ext string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &rotatingFile{
+		dir:      dir,
+		prefix:   prefix,
+		ext:      ext,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+	}, nil
+}
+
+// Write appends data to the current file. Data is never split across files.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil || rf.size+int64(len(b)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Sync commits the current file to disk.
+func (rf *rotatingFile) Sync() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	return rf.f.Sync()
+}
+
+// Close closes the current file.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+// rotate closes the current file, starts a new one and removes old files.
+func (rf *rotatingFile) rotate() error {
+	if rf.f != nil {
+		rf.f.Close()
+		rf.f = nil
+	}
+
+	name := filepath.Join(rf.dir, fmt.Sprintf("%s-%s%s", rf.prefix, time.Now().UTC().Format("20060102T150405.000Z"), rf.ext))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	log.Printf("Writing to %s", name)
+
+	if rf.maxFiles > 0 {
+		files, err := rotatedFiles(rf.dir, rf.prefix, rf.ext)
+		if err != nil {
+			return err
+		}
+		for len(files) > rf.maxFiles {
+			log.Printf("Removing old file %s", files[0])
+			if err := os.Remove(files[0]); err != nil {
+				return err
+			}
+			files = files[1:]
+		}
+	}
+
+	return nil
+}
+
+// rotatedFiles returns the files written by a rotating file with the given
+// prefix and extension, oldest first.
+func rotatedFiles(dir, prefix, ext string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, prefix+"-*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
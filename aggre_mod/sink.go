@@ -0,0 +1,145 @@
+// sink.go defines the Sink interface implemented by each of the outputs that
+// readings are written to, and the sinkSet that fans readings out to several
+// sinks at once.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Sink is an output that readings are written to.
+type Sink interface {
+	// Name returns the name of the sink as shown in logs and on the health
+	// endpoint.
+	Name() string
+
+	// Write writes a reading. Sinks may buffer readings until Flush is
+	// called.
+	Write(r *Reading) error
+
+	// Flush sends any buffered readings.
+	Flush() error
+
+	// Close flushes buffered readings and releases the sink's resources.
+	Close() error
+
+	// Health returns an error if the sink can't currently write readings.
+	Health() error
+}
+
+// sinkStatus is implemented by sinks that report additional status on the
+// health endpoint.
+type sinkStatus interface {
+	Status() string
+}
+
+// sinkOutput feeds readings to a single sink from its own queue so that a
+// slow or failing sink doesn't hold up the others.
+type sinkOutput struct {
+	sink  Sink
+	queue chan *Reading
+	done  chan struct{}
+}
+
+// run writes queued readings to the sink and flushes it periodically until
+// the queue is closed.
+func (o *sinkOutput) run(flushInterval time.Duration) {
+	defer close(o.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	dirty := false
+	for {
+		select {
+		case r, ok := <-o.queue:
+			if !ok {
+				if err := o.sink.Close(); err != nil {
+					log.Printf("Could not close %s: %v", o.sink.Name(), err)
+				}
+				return
+			}
+			start := time.Now()
+			err := o.sink.Write(r)
+			observeSince(sinkLatency, start, o.sink.Name())
+			if err != nil {
+				recordsFailed.Inc(o.sink.Name())
+				log.Printf("Could not send data from %s to %s: %v", r.DeviceId, o.sink.Name(), err)
+				continue
+			}
+			recordsPosted.Inc(o.sink.Name())
+			dirty = true
+		case <-ticker.C:
+			if !dirty {
+				continue
+			}
+			if err := o.sink.Flush(); err != nil {
+				log.Printf("Could not flush %s: %v", o.sink.Name(), err)
+			}
+			dirty = false
+		}
+	}
+}
+
+// sinkSet writes readings to several sinks.
+type sinkSet struct {
+	outputs []*sinkOutput
+	once    sync.Once
+}
+
+// newSinkSet starts writing to the given sinks. Each sink has a queue of
+// queueSize readings and is flushed every flushInterval.
+func newSinkSet(sinks []Sink, queueSize int, flushInterval time.Duration) *sinkSet {
+	set := &sinkSet{}
+	for _, sink := range sinks {
+		o := &sinkOutput{
+			sink:  sink,
+			queue: make(chan *Reading, queueSize),
+			done:  make(chan struct{}),
+		}
+		go o.run(flushInterval)
+		queueLength.Set("sink/"+sink.Name(), func() float64 { return float64(len(o.queue)) })
+		set.outputs = append(set.outputs, o)
+	}
+	return set
+}
+
+// Write queues a reading for every sink that accepts it. Readings are
+// dropped for sinks whose queue is full.
+func (set *sinkSet) Write(r *Reading) {
+	for _, o := range set.outputs {
+		if !sinkAccepts(o.sink, r) {
+			continue
+		}
+		select {
+		case o.queue <- r:
+		default:
+			recordsDropped.Inc(o.sink.Name())
+			log.Printf("%s queue is full, dropping data from %s", o.sink.Name(), r.DeviceId)
+		}
+	}
+}
+
+// Close writes the queued readings and closes every sink.
+func (set *sinkSet) Close() {
+	set.once.Do(func() {
+		for _, o := range set.outputs {
+			close(o.queue)
+		}
+		for _, o := range set.outputs {
+			<-o.done
+		}
+	})
+}
+
+// Sinks returns the sinks in the set.
+func (set *sinkSet) Sinks() []Sink {
+	sinks := make([]Sink, 0, len(set.outputs))
+	for _, o := range set.outputs {
+		sinks = append(sinks, o.sink)
+	}
+	return sinks
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink is a Sink that records the readings written to it. Writes block
+// while the sink is held.
+type testSink struct {
+	name string
+	err  error
+	// written receives each reading as it is written.
+	written chan *Reading
+	hold    chan struct{}
+
+	mu       sync.Mutex
+	readings []*Reading
+	flushed  int
+	closed   bool
+}
+
+func newTestSink(name string) *testSink {
+	return &testSink{name: name, written: make(chan *Reading, 100)}
+}
+
+func (s *testSink) Name() string {
+	return s.name
+}
+
+func (s *testSink) Write(r *Reading) error {
+	if s.hold != nil {
+		s.written <- r
+		<-s.hold
+	}
+	s.mu.Lock()
+	s.readings = append(s.readings, r)
+	s.mu.Unlock()
+	if s.hold == nil {
+		s.written <- r
+	}
+	return s.err
+}
+
+func (s *testSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushed++
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) Health() error {
+	return s.err
+}
+
+// waitWritten waits for a reading to be written to the sink.
+func (s *testSink) waitWritten(t *testing.T) {
+	select {
+	case <-s.written:
+	case <-time.After(time.Second):
+		t.Fatalf("nothing written to %s", s.name)
+	}
+}
+
+// A sink that is stuck or failing doesn't hold up the other sinks. Readings
+// for a sink whose queue is full are dropped.
+func TestSinkSetIsolation(t *testing.T) {
+	const queueSize = 3
+	tests := []struct {
+		name   string
+		blocks bool
+		err    error
+		// The readings the sink is written to, including the one it is
+		// stuck on.
+		want int
+	}{
+		{"stuck", true, nil, 1 + queueSize},
+		{"failing", false, errors.New("unavailable"), 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad := newTestSink("bad-" + tt.name)
+			bad.err = tt.err
+			if tt.blocks {
+				bad.hold = make(chan struct{})
+			}
+			good := newTestSink("good-" + tt.name)
+			set := newSinkSet([]Sink{bad, good}, queueSize, time.Hour)
+
+			for i := 0; i < 10; i++ {
+				set.Write(&Reading{DeviceId: "dev", Timestamp: int64(i)})
+				good.waitWritten(t)
+				// A stuck sink only takes the first reading.
+				if i == 0 || !tt.blocks {
+					bad.waitWritten(t)
+				}
+			}
+			if tt.blocks {
+				close(bad.hold)
+			}
+			set.Close()
+
+			if len(good.readings) != 10 || !good.closed {
+				t.Errorf("%d readings written to the good sink (closed: %v), want 10", len(good.readings), good.closed)
+			}
+			if len(bad.readings) != tt.want || !bad.closed {
+				t.Errorf("%d readings written to the %s sink (closed: %v), want %d", len(bad.readings), tt.name, bad.closed, tt.want)
+			}
+			for i, r := range bad.readings {
+				if r.Timestamp != int64(i) {
+					t.Errorf("reading %d written to the %s sink has timestamp %d", i, tt.name, r.Timestamp)
+				}
+			}
+		})
+	}
+}
+
+func TestSinkSetFlush(t *testing.T) {
+	sink := newTestSink("flushed")
+	set := newSinkSet([]Sink{sink}, 10, 10*time.Millisecond)
+	defer set.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	sink.mu.Lock()
+	flushed := sink.flushed
+	sink.mu.Unlock()
+	if flushed != 0 {
+		t.Errorf("sink without readings flushed %d times", flushed)
+	}
+
+	set.Write(&Reading{DeviceId: "dev"})
+	sink.waitWritten(t)
+	deadline := time.Now().Add(time.Second)
+	for {
+		sink.mu.Lock()
+		flushed = sink.flushed
+		sink.mu.Unlock()
+		if flushed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sink not flushed after a reading was written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,138 @@
+// skew.go implements detection of devices whose clock is wrong. Devices only
+// sync their clock with the Particle cloud once a day, so a device whose
+// clock hasn't synced yet reports readings taken in 1970 or in the future.
+// The timestamp of each reading is compared to the time the Particle API
+// received it and readings whose clock skew exceeds a threshold can keep the
+// device's timestamp, have it replaced with the publish time or have it
+// corrected by the device's typical skew.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The actions taken on the timestamps of skewed readings.
+const (
+	skewActionKeep    = "keep"
+	skewActionReplace = "replace"
+	skewActionCorrect = "correct"
+)
+
+// The number of recent skews of each device that the typical skew is the
+// median of.
+const skewHistorySize = 10
+
+// clockSkew returns the difference in seconds between the time the device
+// says a reading was taken and the time it was published. It returns false
+// if the publish time isn't known.
+func (r *Reading) clockSkew() (int64, bool) {
+	if r.PublishedAt == 0 {
+		return 0, false
+	}
+	if r.DeviceTimestamp != 0 {
+		return r.DeviceTimestamp - r.PublishedAt, true
+	}
+	return r.Timestamp - r.PublishedAt, true
+}
+
+// skewFilter detects and fixes the timestamps of readings from devices with
+// skewed clocks.
+type skewFilter struct {
+	threshold int64
+	action    string
+
+	mu sync.Mutex
+	// The recent skews of each device, oldest first.
+	skews map[string][]int64
+}
+
+// The clock skew filter in use.
+var skews *skewFilter
+
+// newSkewFilter creates a filter that takes the given action on readings
+// whose skew is larger than threshold.
+func newSkewFilter(threshold time.Duration, action string) (*skewFilter, error) {
+	if action != skewActionKeep && action != skewActionReplace && action != skewActionCorrect {
+		return nil, fmt.Errorf("unknown clock skew action %q", action)
+	}
+	return &skewFilter{
+		threshold: int64(threshold / time.Second),
+		action:    action,
+		skews:     make(map[string][]int64),
+	}, nil
+}
+
+// typicalSkew adds the skew of a device's reading to its recent skews and
+// returns their median. Using the median rather than the latest skew keeps
+// readings that the device buffered while offline in order.
+func (f *skewFilter) typicalSkew(id string, skew int64) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recent := append(f.skews[id], skew)
+	if len(recent) > skewHistorySize {
+		recent = recent[len(recent)-skewHistorySize:]
+	}
+	f.skews[id] = recent
+
+	values := make([]float64, len(recent))
+	for i, s := range recent {
+		values[i] = float64(s)
+	}
+	return int64(median(values))
+}
+
+// History returns a copy of the recent skews of a device, oldest first.
+func (f *skewFilter) History(id string) []int64 {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int64(nil), f.skews[id]...)
+}
+
+// Restore sets the recent skews of a device that aren't known yet, e.g. from
+// the state file.
+func (f *skewFilter) Restore(id string, recent []int64) {
+	if f == nil || len(recent) == 0 {
+		return
+	}
+	if len(recent) > skewHistorySize {
+		recent = recent[len(recent)-skewHistorySize:]
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.skews[id]; !ok {
+		f.skews[id] = append([]int64(nil), recent...)
+	}
+}
+
+// Check sets whether a reading's clock is skewed and fixes its timestamp
+// according to the filter's action. The device's timestamp is kept in
+// DeviceTimestamp if it is changed.
+func (f *skewFilter) Check(r *Reading) {
+	skew, ok := r.clockSkew()
+	if f == nil || !ok {
+		return
+	}
+
+	typical := f.typicalSkew(r.DeviceId, skew)
+	if skew <= f.threshold && skew >= -f.threshold {
+		return
+	}
+	r.ClockSkewed = true
+	skewedReadings.Inc(r.Source, f.action)
+
+	switch f.action {
+	case skewActionReplace:
+		r.DeviceTimestamp = r.Timestamp
+		r.Timestamp = r.PublishedAt
+	case skewActionCorrect:
+		r.DeviceTimestamp = r.Timestamp
+		r.Timestamp -= typical
+	}
+}
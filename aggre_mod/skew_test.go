@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkewFilterCheck(t *testing.T) {
+	const published = 1500000000
+	tests := []struct {
+		name            string
+		action          string
+		reading         Reading
+		skewed          bool
+		timestamp       int64
+		deviceTimestamp int64
+	}{
+		{
+			name:      "in sync",
+			action:    skewActionReplace,
+			reading:   Reading{Timestamp: published - 30, PublishedAt: published},
+			timestamp: published - 30,
+		},
+		{
+			name:      "no publish time",
+			action:    skewActionReplace,
+			reading:   Reading{Timestamp: 86400},
+			timestamp: 86400,
+		},
+		{
+			name:      "keep",
+			action:    skewActionKeep,
+			reading:   Reading{Timestamp: 86400, PublishedAt: published},
+			skewed:    true,
+			timestamp: 86400,
+		},
+		{
+			name:            "replace",
+			action:          skewActionReplace,
+			reading:         Reading{Timestamp: 86400, PublishedAt: published},
+			skewed:          true,
+			timestamp:       published,
+			deviceTimestamp: 86400,
+		},
+		{
+			name:            "replace in the future",
+			action:          skewActionReplace,
+			reading:         Reading{Timestamp: published + 3600, PublishedAt: published},
+			skewed:          true,
+			timestamp:       published,
+			deviceTimestamp: published + 3600,
+		},
+		{
+			name:            "correct",
+			action:          skewActionCorrect,
+			reading:         Reading{Timestamp: published + 3600, PublishedAt: published},
+			skewed:          true,
+			timestamp:       published,
+			deviceTimestamp: published + 3600,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newSkewFilter(time.Minute, tt.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := tt.reading
+			r.DeviceId = "dev"
+			f.Check(&r)
+			if r.ClockSkewed != tt.skewed || r.Timestamp != tt.timestamp || r.DeviceTimestamp != tt.deviceTimestamp {
+				t.Errorf("Check() = skewed %v, timestamp %d, device timestamp %d; want %v, %d, %d",
+					r.ClockSkewed, r.Timestamp, r.DeviceTimestamp, tt.skewed, tt.timestamp, tt.deviceTimestamp)
+			}
+		})
+	}
+
+	if _, err := newSkewFilter(time.Minute, "fix"); err == nil {
+		t.Error("newSkewFilter() accepted an unknown action")
+	}
+}
+
+// Corrected timestamps use the median of the recent skews so that readings
+// the device buffered while offline stay in order.
+func TestSkewFilterCorrectMedian(t *testing.T) {
+	f, err := newSkewFilter(time.Minute, skewActionCorrect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		timestamp, published int64
+		want                 int64
+	}{
+		{1500003600, 1500000000, 1500000000},
+		{1500003700, 1500000100, 1500000100},
+		// Buffered while offline: published much later than it was taken.
+		{1500003800, 1500009000, 1500000200},
+		{1500003900, 1500000300, 1500000300},
+	}
+	for _, tt := range tests {
+		r := &Reading{DeviceId: "dev", Timestamp: tt.timestamp, PublishedAt: tt.published}
+		f.Check(r)
+		if r.Timestamp != tt.want {
+			t.Errorf("corrected %d published at %d to %d, want %d", tt.timestamp, tt.published, r.Timestamp, tt.want)
+		}
+	}
+
+	var nilFilter *skewFilter
+	r := &Reading{DeviceId: "dev", Timestamp: 86400, PublishedAt: 1500000000}
+	nilFilter.Check(r)
+	if r.ClockSkewed || r.Timestamp != 86400 {
+		t.Errorf("nil filter changed the reading to %+v", r)
+	}
+}
@@ -0,0 +1,134 @@
+// source.go defines the Source interface implemented by each of the inputs
+// that aggre_mod receives device data from.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Reading is a normalized reading received from a device.
+type Reading struct {
+	// Source is the name of the source the reading was received from.
+	Source string
+	// DeviceId identifies the device that took the reading.
+	DeviceId string
+	// Event is the name of the event the reading was published as. It is
+	// empty for sources that don't have event names.
+	Event string
+	// Timestamp is the time the reading was taken in seconds since the epoch.
+	Timestamp int64
+	// PublishedAt is the time the reading was published to the Particle API
+	// in seconds since the epoch. It is zero for other sources.
+	PublishedAt int64
+	// DeviceTimestamp is the timestamp reported by the device if Timestamp
+	// was changed because the device's clock is skewed (see skew.go).
+	DeviceTimestamp int64
+	// ClockSkewed is set if the device's clock is skewed.
+	ClockSkewed bool
+	// Values holds the measured values keyed by metric name.
+	Values map[string]float64
+	// Id identifies the reading across sources and retries (see dedup.go).
+	Id string
+	// Rejection is set if the reading failed validation and is quarantined.
+	Rejection *readingRejection
+	// Outliers maps the metrics whose values are outliers to the rule they
+	// failed.
+	Outliers map[string]string
+}
+
+// Record returns the reading as a record suitable for sending to Fluentd.
+func (r *Reading) Record() map[string]interface{} {
+	record := make(map[string]interface{})
+	record["deviceid"] = r.DeviceId
+	record["timestamp"] = r.Timestamp
+	if r.Id != "" {
+		record["record_id"] = r.Id
+	}
+	if r.Event != "" {
+		record["event"] = r.Event
+	}
+	if r.PublishedAt != 0 {
+		record["published_at"] = r.PublishedAt
+	}
+	if r.DeviceTimestamp != 0 {
+		record["device_timestamp"] = r.DeviceTimestamp
+	}
+	for _, m := range metrics.Metrics {
+		val, ok := r.Values[m.Name]
+		// NaN and infinite values, which are quarantined, can't be encoded
+		// in most formats.
+		if !ok || math.IsNaN(val) || math.IsInf(val, 0) {
+			continue
+		}
+		record[m.Name] = m.Value(val)
+	}
+	if r.Rejection != nil {
+		record["rejected_metric"] = r.Rejection.Metric
+		record["rejected_rule"] = r.Rejection.Rule
+	}
+	r.annotateOutliers(record)
+	return record
+}
+
+// Source is an input that device readings are received from.
+type Source interface {
+	// Name returns the name of the source as shown in logs and on the health
+	// endpoint.
+	Name() string
+
+	// Start connects to the source in the background. Readings are sent to
+	// the readings channel and errors that occur while reading data are sent
+	// to the errs channel. Sources reconnect on their own if the connection
+	// is lost.
+	Start(readings chan<- *Reading, errs chan<- error)
+
+	// Stop disconnects from the source.
+	Stop()
+
+	// Connected returns true if the source is currently connected.
+	Connected() bool
+}
+
+// sourceState holds the connection state shared by source implementations.
+type sourceState struct {
+	mu        sync.Mutex
+	connected bool
+	done      chan struct{}
+}
+
+func newSourceState() sourceState {
+	return sourceState{done: make(chan struct{})}
+}
+
+// Connected returns true if the source is currently connected.
+func (s *sourceState) Connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// setConnected updates the connection state of the source.
+func (s *sourceState) setConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+}
+
+// stop signals the source's goroutines to exit.
+func (s *sourceState) stop() {
+	close(s.done)
+}
+
+// wait waits for the given duration and returns false if the source was
+// stopped in the meantime.
+func (s *sourceState) wait(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.done:
+		return false
+	}
+}
@@ -0,0 +1,402 @@
+// spool.go implements a disk-backed, append-only queue used to hold
+// records that could not be delivered until they can be sent again.
+//
+// The spool is a directory of segment files. Each entry is stored as an
+// 8 byte timestamp (nanoseconds since the epoch), a 4 byte length and the
+// data itself. The position of the next entry to be read is saved in a
+// cursor file so that delivered entries aren't sent again after a restart.
+// Segments are deleted once they have been read and the oldest segments are
+// dropped if the spool grows larger than its size limit.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentBytes = 1024 * 1024
+	spoolHeaderBytes  = 12
+	spoolCursorFile   = "cursor"
+)
+
+// spoolEntry is an entry read from the spool. The segment and offset
+// identify the entry when it is removed.
+type spoolEntry struct {
+	Time time.Time
+	Data []byte
+
+	segment int64
+	offset  int64
+}
+
+// spool is a disk-backed FIFO queue of records.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu sync.Mutex
+	// Segment sequence numbers, oldest first. The last segment is the one
+	// being written to.
+	segments []int64
+	// The sequence number of the last segment created. Sequence numbers are
+	// never reused so that entries of removed segments can't be mistaken
+	// for new ones.
+	lastSegment int64
+	w           *os.File
+	wsize       int64
+	// The total size of all segments.
+	size int64
+
+	// The read position in the first segment.
+	readOffset int64
+	r          *os.File
+
+	// The number of unread entries and the time of the oldest one.
+	count  int
+	oldest time.Time
+}
+
+// openSpool opens the spool in the given directory, creating it if
+// necessary. Entries older than maxAge are discarded when read and the
+// oldest segments are dropped when the spool grows larger than maxBytes.
+func openSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "segment-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		seq, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(name), "segment-"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seq)
+		s.size += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	if len(s.segments) > 0 {
+		s.lastSegment = s.segments[len(s.segments)-1]
+	}
+
+	if err := s.readCursor(); err != nil {
+		return nil, err
+	}
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+
+	if s.count > 0 {
+		log.Printf("Opened spool %s with %d records", dir, s.count)
+	}
+
+	return s, nil
+}
+
+// segmentPath returns the path of the segment with the given sequence
+// number.
+func (s *spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("segment-%020d", seq))
+}
+
+// readCursor reads the saved read position. Segments older than the
+// cursor's segment have already been read and are removed.
+func (s *spool) readCursor() error {
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var seq, offset int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seq, &offset); err != nil {
+		return fmt.Errorf("invalid spool cursor: %v", err)
+	}
+	for len(s.segments) > 0 && s.segments[0] < seq {
+		s.removeFirst()
+	}
+	if len(s.segments) > 0 && s.segments[0] == seq {
+		s.readOffset = offset
+	}
+	if seq > s.lastSegment {
+		s.lastSegment = seq
+	}
+	return nil
+}
+
+// writeCursor saves the read position.
+func (s *spool) writeCursor() error {
+	var seq int64
+	if len(s.segments) > 0 {
+		seq = s.segments[0]
+	}
+	path := filepath.Join(s.dir, spoolCursorFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seq, s.readOffset)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// scan counts the unread entries and finds the time of the oldest one.
+func (s *spool) scan() error {
+	s.count = 0
+	s.oldest = time.Time{}
+	for i, seq := range s.segments {
+		f, err := os.Open(s.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			if _, err := f.Seek(s.readOffset, io.SeekStart); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		r := bufio.NewReader(f)
+		for {
+			t, _, err := readSpoolEntry(r)
+			if err != nil {
+				break
+			}
+			if s.count == 0 {
+				s.oldest = t
+			}
+			s.count++
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// Append adds an entry to the end of the spool.
+func (s *spool) Append(t time.Time, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.w == nil || s.wsize >= spoolSegmentBytes {
+		if err := s.newSegment(); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, spoolHeaderBytes)
+	binary.BigEndian.PutUint64(header, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(data)))
+	n, err := s.w.Write(append(header, data...))
+	s.wsize += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if s.count == 0 {
+		s.oldest = t
+	}
+	s.count++
+
+	// Drop the oldest segments if the spool is too large.
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.segments) > 1 {
+		log.Printf("Spool is larger than %d bytes, dropping oldest records", s.maxBytes)
+		s.removeFirst()
+		if err := s.writeCursor(); err != nil {
+			return err
+		}
+		if err := s.scan(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newSegment starts a new segment for writing.
+func (s *spool) newSegment() error {
+	if s.w != nil {
+		s.w.Close()
+	}
+
+	seq := s.lastSegment + 1
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.lastSegment = seq
+	s.segments = append(s.segments, seq)
+	s.w = f
+	s.wsize = 0
+	return nil
+}
+
+// removeFirst deletes the oldest segment.
+func (s *spool) removeFirst() {
+	seq := s.segments[0]
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	if len(s.segments) == 1 && s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	if info, err := os.Stat(s.segmentPath(seq)); err == nil {
+		s.size -= info.Size()
+	}
+	os.Remove(s.segmentPath(seq))
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+}
+
+// Peek returns the oldest unread entry without removing it. Entries older
+// than the spool's maximum age are discarded. ok is false if the spool is
+// empty.
+func (s *spool) Peek() (e spoolEntry, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var t time.Time
+	var data []byte
+	for s.count > 0 {
+		if s.r == nil {
+			s.r, err = os.Open(s.segmentPath(s.segments[0]))
+			if err != nil {
+				return
+			}
+		}
+		if _, err = s.r.Seek(s.readOffset, io.SeekStart); err != nil {
+			return
+		}
+
+		t, data, err = readSpoolEntry(bufio.NewReader(s.r))
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The end of the segment was reached. Move on to the next one
+			// unless this is the segment being written to.
+			if len(s.segments) == 1 {
+				s.count = 0
+				return e, false, nil
+			}
+			s.removeFirst()
+			if err = s.writeCursor(); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if s.maxAge > 0 && time.Since(t) > s.maxAge {
+			log.Printf("Dropping spooled record from %s older than %s", t.Format(time.RFC3339), s.maxAge)
+			if err = s.advance(len(data)); err != nil {
+				return
+			}
+			continue
+		}
+
+		return spoolEntry{t, data, s.segments[0], s.readOffset}, true, nil
+	}
+	return e, false, nil
+}
+
+// Remove removes an entry returned by Peek. It does nothing if the entry is
+// no longer the oldest one, e.g. because its segment was dropped when the
+// spool grew too large.
+func (s *spool) Remove(e spoolEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 || len(s.segments) == 0 || s.segments[0] != e.segment || s.readOffset != e.offset {
+		return nil
+	}
+	return s.advance(len(e.Data))
+}
+
+// advance moves the read position past an entry with n bytes of data.
+func (s *spool) advance(n int) error {
+	s.readOffset += int64(spoolHeaderBytes + n)
+	s.count--
+	if s.count == 0 {
+		s.oldest = time.Time{}
+		// Everything has been read. Start over with a fresh segment.
+		for len(s.segments) > 0 {
+			s.removeFirst()
+		}
+	} else if err := s.updateOldest(); err != nil {
+		return err
+	}
+	return s.writeCursor()
+}
+
+// updateOldest reads the time of the next entry.
+func (s *spool) updateOldest() error {
+	if _, err := s.r.Seek(s.readOffset, io.SeekStart); err != nil {
+		return err
+	}
+	t, _, err := readSpoolEntry(bufio.NewReader(s.r))
+	if err == nil {
+		s.oldest = t
+	}
+	return nil
+}
+
+// Len returns the number of unread entries.
+func (s *spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Oldest returns the time of the oldest unread entry or the zero time if
+// the spool is empty.
+func (s *spool) Oldest() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.oldest
+}
+
+// readSpoolEntry reads a single entry.
+func readSpoolEntry(r io.Reader) (time.Time, []byte, error) {
+	header := make([]byte, spoolHeaderBytes)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return time.Time{}, nil, err
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(header)))
+	n := binary.BigEndian.Uint32(header[8:])
+	if n > spoolSegmentBytes*16 {
+		return t, nil, errors.New("corrupt spool entry")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return t, nil, err
+	}
+	return t, data, nil
+}
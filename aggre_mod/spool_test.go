@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// drainSpool reads and removes every entry of a spool.
+func drainSpool(t *testing.T, s *spool) []string {
+	got := []string{}
+	for {
+		e, ok, err := s.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return got
+		}
+		got = append(got, string(e.Data))
+		if err := s.Remove(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		// The entries appended and how long ago each was spooled.
+		entries []string
+		ages    []time.Duration
+		// The number of entries read before the spool is reopened.
+		readBeforeReopen int
+		want             []string
+	}{
+		{
+			name:    "in order",
+			entries: []string{"a", "b", "c"},
+			want:    []string{"a", "b", "c"},
+		},
+		{
+			name:             "cursor survives reopening",
+			entries:          []string{"a", "b", "c"},
+			readBeforeReopen: 2,
+			want:             []string{"c"},
+		},
+		{
+			name:    "old entries are dropped",
+			maxAge:  time.Hour,
+			entries: []string{"a", "b", "c"},
+			ages:    []time.Duration{2 * time.Hour, 30 * time.Minute, 0},
+			want:    []string{"b", "c"},
+		},
+		{
+			name:    "empty",
+			entries: []string{},
+			want:    []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			s, err := openSpool(dir, 0, tt.maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, data := range tt.entries {
+				ts := now
+				if i < len(tt.ages) {
+					ts = now.Add(-tt.ages[i])
+				}
+				if err := s.Append(ts, []byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.readBeforeReopen > 0 {
+				for i := 0; i < tt.readBeforeReopen; i++ {
+					e, ok, err := s.Peek()
+					if err != nil || !ok {
+						t.Fatalf("Peek() = %v, %v", ok, err)
+					}
+					if err := s.Remove(e); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if s.w != nil {
+					s.w.Close()
+				}
+				if s, err = openSpool(dir, 0, tt.maxAge); err != nil {
+					t.Fatal(err)
+				}
+				if s.Len() != len(tt.want) {
+					t.Errorf("Len() after reopening = %d, want %d", s.Len(), len(tt.want))
+				}
+			}
+
+			got := drainSpool(t, s)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+			if s.Len() != 0 {
+				t.Errorf("Len() = %d after reading everything", s.Len())
+			}
+		})
+	}
+}
+
+// An entry whose segment was dropped while it was being sent must not be
+// mistaken for the entry that is now the oldest.
+func TestSpoolRemoveAfterEviction(t *testing.T) {
+	entry := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, spoolSegmentBytes*2/5)
+	}
+	s, err := openSpool(tempDir(t), spoolSegmentBytes*3/2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(time.Now(), entry('a')); err != nil {
+		t.Fatal(err)
+	}
+	e, ok, err := s.Peek()
+	if err != nil || !ok {
+		t.Fatalf("Peek() = %v, %v", ok, err)
+	}
+
+	// The fourth entry starts a second segment which makes the spool too
+	// large, so the first segment is dropped.
+	for _, c := range []byte("bcd") {
+		if err := s.Append(time.Now(), entry(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Len() = %d after eviction, want 1", s.Len())
+	}
+
+	if err := s.Remove(e); err != nil {
+		t.Fatal(err)
+	}
+	got := drainSpool(t, s)
+	if len(got) != 1 || got[0][0] != 'd' {
+		t.Errorf("read %d entries after removing an evicted one, want only d", len(got))
+	}
+}
@@ -0,0 +1,117 @@
+// state.go implements saving the device registry to a local file and
+// restoring it at startup so that device state survives restarts.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// savedDevice is the state of a device as it is saved to the state file.
+type savedDevice struct {
+	Id          string             `json:"id"`
+	Values      map[string]float64 `json:"values"`
+	FirstSeen   int64              `json:"first_seen"`
+	LastSeen    int64              `json:"last_seen"`
+	Active      bool               `json:"active"`
+	ClockSkew   *int64             `json:"clock_skew,omitempty"`
+	ClockSkewed bool               `json:"clock_skewed,omitempty"`
+	// The recent clock skews that corrected timestamps are based on.
+	RecentSkews []int64 `json:"recent_skews,omitempty"`
+}
+
+// savedState is the content of the state file.
+type savedState struct {
+	SavedAt int64         `json:"saved_at"`
+	Devices []savedDevice `json:"devices"`
+}
+
+// saveDeviceState writes a snapshot of the registry to the given path. The
+// file is replaced atomically so that a crash while saving doesn't leave a
+// corrupt file behind.
+func saveDeviceState(reg *deviceRegistry, path string) error {
+	state := savedState{SavedAt: time.Now().Unix()}
+	for _, d := range reg.Snapshot() {
+		state.Devices = append(state.Devices, savedDevice{
+			Id:          d.Id,
+			Values:      d.Values,
+			FirstSeen:   d.FirstSeen,
+			LastSeen:    d.LastSeen,
+			Active:      d.Active,
+			ClockSkew:   d.ClockSkew,
+			ClockSkewed: d.ClockSkewed,
+			RecentSkews: skews.History(d.Id),
+		})
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadDeviceState restores the registry from the state file at the given
+// path. A missing file is not an error.
+func loadDeviceState(reg *deviceRegistry, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var state savedState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return err
+	}
+
+	restored := []Device{}
+	for _, d := range state.Devices {
+		restored = append(restored, Device{
+			Id:          d.Id,
+			Values:      d.Values,
+			FirstSeen:   d.FirstSeen,
+			LastSeen:    d.LastSeen,
+			ClockSkew:   d.ClockSkew,
+			ClockSkewed: d.ClockSkewed,
+		})
+		skews.Restore(d.Id, d.RecentSkews)
+	}
+	reg.Restore(restored)
+
+	log.Printf("Restored %d devices from %s (saved at %s)", len(restored), path, time.Unix(state.SavedAt, 0).UTC().Format(time.RFC3339))
+	return nil
+}
+
+// persistDeviceState periodically saves the registry to the given path. It
+// never returns.
+func persistDeviceState(reg *deviceRegistry, path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := saveDeviceState(reg, path); err != nil {
+			log.Printf("Could not save device state to %s: %v", path, err)
+		}
+	}
+}
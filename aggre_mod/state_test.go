@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Saving the registry and loading it into a new one restores every device
+// as inactive.
+func TestDeviceStateRoundTrip(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name     string
+		readings []*Reading
+	}{
+		{"no devices", nil},
+		{
+			name: "devices",
+			readings: []*Reading{
+				{DeviceId: "dev1", Timestamp: now - 120, Values: map[string]float64{"temp": 20}},
+				{DeviceId: "dev2", Timestamp: now - 60, Values: map[string]float64{"humidity": 40}},
+				{DeviceId: "dev1", Timestamp: now, Values: map[string]float64{"temp": 21.5, "humidity": 41}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "state.json")
+			saved := newDeviceRegistry(time.Hour, 10)
+			for _, r := range tt.readings {
+				saved.Update(r)
+			}
+			if err := saveDeviceState(saved, path); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state savedState
+			if err := json.Unmarshal(b, &state); err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range state.Devices {
+				if !d.Active {
+					t.Errorf("device %s saved as inactive", d.Id)
+				}
+			}
+
+			restored := newDeviceRegistry(time.Hour, 10)
+			if err := loadDeviceState(restored, path); err != nil {
+				t.Fatal(err)
+			}
+			want := saved.Snapshot()
+			got := restored.Snapshot()
+			if len(got) != len(want) {
+				t.Fatalf("restored %d devices, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i].Active {
+					t.Errorf("restored device %s is active", got[i].Id)
+				}
+				got[i].Active = want[i].Active
+				if fmt.Sprintf("%+v", got[i]) != fmt.Sprintf("%+v", want[i]) {
+					t.Errorf("restored %+v, want %+v", got[i], want[i])
+				}
+			}
+
+			// Devices become active again once their last seen time is
+			// checked.
+			restored.updateActive()
+			for _, d := range restored.Snapshot() {
+				if !d.Active {
+					t.Errorf("device %s is inactive after updating", d.Id)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadDeviceState(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		devices int
+		invalid bool
+	}{
+		{name: "missing file"},
+		{name: "corrupt file", content: `{"devices":[`, invalid: true},
+		{name: "empty state", content: `{"saved_at":1500000000,"devices":[]}`},
+		{name: "one device", content: `{"saved_at":1500000000,"devices":[{"id":"dev","values":{"temp":20},"first_seen":1,"last_seen":2}]}`, devices: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "state.json")
+			if tt.content != "" {
+				if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reg := newDeviceRegistry(time.Hour, 10)
+			err := loadDeviceState(reg, path)
+			if tt.invalid {
+				if err == nil {
+					t.Error("loadDeviceState() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(reg.Snapshot()); n != tt.devices {
+				t.Errorf("restored %d devices, want %d", n, tt.devices)
+			}
+		})
+	}
+}
+
+// The clock skew of devices and the recent skews that corrected timestamps
+// are based on survive restarts.
+func TestDeviceStateClockSkew(t *testing.T) {
+	oldSkews := skews
+	defer func() { skews = oldSkews }()
+	var err error
+	if skews, err = newSkewFilter(time.Minute, skewActionCorrect); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	path := filepath.Join(tempDir(t), "state.json")
+	saved := newDeviceRegistry(time.Hour, 10)
+	for i, skew := range []int64{3600, 3605, 3610} {
+		r := &Reading{DeviceId: "dev", Timestamp: now + int64(i) + skew, PublishedAt: now + int64(i), Values: map[string]float64{"temp": 20}}
+		skews.Check(r)
+		saved.Update(r)
+	}
+	if err := saveDeviceState(saved, path); err != nil {
+		t.Fatal(err)
+	}
+
+	skews, _ = newSkewFilter(time.Minute, skewActionCorrect)
+	restored := newDeviceRegistry(time.Hour, 10)
+	if err := loadDeviceState(restored, path); err != nil {
+		t.Fatal(err)
+	}
+	d, ok := restored.Get("dev")
+	if !ok {
+		t.Fatal("device not restored")
+	}
+	if d.ClockSkew == nil || *d.ClockSkew != 3610 || !d.ClockSkewed {
+		t.Errorf("restored clock skew %v (skewed: %v), want 3610", d.ClockSkew, d.ClockSkewed)
+	}
+	if got := skews.History("dev"); fmt.Sprint(got) != "[3600 3605 3610]" {
+		t.Errorf("restored recent skews %v, want [3600 3605 3610]", got)
+	}
+}
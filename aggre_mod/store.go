@@ -0,0 +1,341 @@
+// store.go implements a local, file-based store of every reading so that
+// recent history can be queried without BigQuery.
+//
+// Readings are appended as NDJSON to one file per device and UTC day, named
+// <dir>/<device id>/<yyyy-mm-dd>.ndjson. Rollups of the readings are kept in
+// the same directory (see rollup.go). Files of days older than the retention
+// period are deleted, except for hourly and daily rollups.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const storeDayFormat = "2006-01-02"
+
+// storedReading is a reading as it is saved in the store.
+type storedReading struct {
+	Timestamp int64              `json:"t"`
+	Id        string             `json:"id,omitempty"`
+	Published int64              `json:"p,omitempty"`
+	Device    int64              `json:"dt,omitempty"`
+	Source    string             `json:"s,omitempty"`
+	Event     string             `json:"e,omitempty"`
+	Values    map[string]float64 `json:"v"`
+	Outliers  map[string]string  `json:"o,omitempty"`
+}
+
+// storeCursor is the position of a reading in the store. Readings are
+// ordered by timestamp and then by the order they were stored in.
+type storeCursor struct {
+	Timestamp int64
+	Offset    int64
+}
+
+// parseStoreCursor parses a cursor returned by String.
+func parseStoreCursor(s string) (storeCursor, error) {
+	var c storeCursor
+	if _, err := fmt.Sscanf(s, "%d-%d", &c.Timestamp, &c.Offset); err != nil {
+		return c, fmt.Errorf("invalid cursor %q", s)
+	}
+	return c, nil
+}
+
+func (c storeCursor) String() string {
+	return fmt.Sprintf("%d-%d", c.Timestamp, c.Offset)
+}
+
+// after returns true if the position is after c.
+func (c storeCursor) after(o storeCursor) bool {
+	return c.Timestamp > o.Timestamp || c.Timestamp == o.Timestamp && c.Offset > o.Offset
+}
+
+// readingStore is a Sink that saves readings to the store.
+type readingStore struct {
+	dir       string
+	retention time.Duration
+	rollups   *rollups
+
+	mu sync.RWMutex
+}
+
+// The store of readings. It is nil if no store directory is configured.
+var store *readingStore
+
+// openStore opens the store in the given directory, creating it if
+// necessary. If retention is zero readings are kept forever. Daily rollups
+// start at midnight in the given location.
+func openStore(dir string, retention time.Duration, loc *time.Location) (*readingStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &readingStore{dir: dir, retention: retention}
+	s.rollups = newRollups(s, loc)
+	return s, nil
+}
+
+// deviceDir returns the directory holding a device's readings.
+func (s *readingStore) deviceDir(id string) string {
+	name := url.PathEscape(id)
+	// PathEscape leaves dots alone so that an ID of . or .. would name the
+	// store or its parent directory.
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return filepath.Join(s.dir, name)
+}
+
+// dayPath returns the path of the file holding a device's readings for the
+// UTC day of the given time.
+func (s *readingStore) dayPath(id string, t time.Time) string {
+	return filepath.Join(s.deviceDir(id), t.UTC().Format(storeDayFormat)+".ndjson")
+}
+
+// appendLine appends a line to a file, creating it and its directory if
+// necessary.
+func appendLine(path string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *readingStore) Name() string {
+	return "store"
+}
+
+// Write appends a reading to the store.
+func (s *readingStore) Write(r *Reading) error {
+	b, err := json.Marshal(storedReading{
+		Timestamp: r.Timestamp,
+		Id:        r.Id,
+		Published: r.PublishedAt,
+		Device:    r.DeviceTimestamp,
+		Source:    r.Source,
+		Event:     r.Event,
+		Values:    r.Values,
+		Outliers:  r.Outliers,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	err = appendLine(s.dayPath(r.DeviceId, time.Unix(r.Timestamp, 0)), b)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.rollups.Add(r)
+	return nil
+}
+
+// Flush writes completed rollups. Readings are written to disk as they
+// arrive.
+func (s *readingStore) Flush() error {
+	return s.rollups.Flush(time.Now(), false)
+}
+
+// Close writes all rollups, including incomplete ones.
+func (s *readingStore) Close() error {
+	return s.rollups.Flush(time.Now(), true)
+}
+
+func (s *readingStore) Health() error {
+	return nil
+}
+
+// storeEntry is a reading read from the store with its position.
+type storeEntry struct {
+	cursor  storeCursor
+	reading *Reading
+}
+
+// readDay reads a device's readings for a single day with timestamps in
+// [from, to), sorted by position.
+func (s *readingStore) readDay(id string, day time.Time, from, to int64) ([]storeEntry, error) {
+	s.mu.RLock()
+	b, err := ioutil.ReadFile(s.dayPath(id, day))
+	s.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []storeEntry{}
+	var offset int64
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			// An incomplete line that is still being written.
+			break
+		}
+		line := b[:i]
+		lineOffset := offset
+		b = b[i+1:]
+		offset += int64(i + 1)
+
+		var sr storedReading
+		if err := json.Unmarshal(line, &sr); err != nil {
+			log.Printf("Skipping corrupt reading in %s at offset %d: %v", s.dayPath(id, day), lineOffset, err)
+			continue
+		}
+		if sr.Timestamp < from || sr.Timestamp >= to {
+			continue
+		}
+		entries = append(entries, storeEntry{
+			cursor: storeCursor{sr.Timestamp, lineOffset},
+			reading: &Reading{
+				Source:          sr.Source,
+				DeviceId:        id,
+				Event:           sr.Event,
+				Timestamp:       sr.Timestamp,
+				Id:              sr.Id,
+				PublishedAt:     sr.Published,
+				DeviceTimestamp: sr.Device,
+				Values:          sr.Values,
+				Outliers:        sr.Outliers,
+			},
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[j].cursor.after(entries[i].cursor) })
+	return entries, nil
+}
+
+// storedDays returns the first and last UTC day of which a device has
+// readings in the store. ok is false if it has none.
+func (s *readingStore) storedDays(id string) (first, last time.Time, ok bool, err error) {
+	s.mu.RLock()
+	files, err := ioutil.ReadDir(s.deviceDir(id))
+	s.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return first, last, false, nil
+	}
+	if err != nil {
+		return first, last, false, err
+	}
+	for _, f := range files {
+		// Rollup files don't parse as days.
+		day, err := time.Parse(storeDayFormat+".ndjson", f.Name())
+		if err != nil {
+			continue
+		}
+		if !ok || day.Before(first) {
+			first = day
+		}
+		if !ok || day.After(last) {
+			last = day
+		}
+		ok = true
+	}
+	return first, last, ok, nil
+}
+
+// Query returns up to limit readings of a device with timestamps in
+// [from, to), oldest first. If after is not nil only readings after that
+// position are returned. The returned cursor is the position to continue
+// from or nil if there are no more readings.
+func (s *readingStore) Query(id string, from, to int64, after *storeCursor, limit int) ([]*Reading, *storeCursor, error) {
+	if after != nil && after.Timestamp > from {
+		from = after.Timestamp
+	}
+
+	readings := []*Reading{}
+	first, last, ok, err := s.storedDays(id)
+	if err != nil || !ok {
+		return readings, nil, err
+	}
+
+	// Each day's file only holds readings taken that day so reading the
+	// files in order returns readings in timestamp order. Days before the
+	// first and after the last file are skipped, e.g. if from is 0.
+	start := time.Unix(from, 0).UTC().Truncate(24 * time.Hour)
+	if start.Before(first) {
+		start = first
+	}
+	for day := start; day.Unix() < to && !day.After(last); day = day.Add(24 * time.Hour) {
+		entries, err := s.readDay(id, day, from, to)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			if after != nil && !e.cursor.after(*after) {
+				continue
+			}
+			if len(readings) == limit {
+				// There is at least one more reading. Continue after the
+				// last one returned.
+				return readings, after, nil
+			}
+			readings = append(readings, e.reading)
+			cursor := e.cursor
+			after = &cursor
+		}
+	}
+	return readings, nil, nil
+}
+
+// expire deletes readings and minute rollups of days older than the
+// retention period.
+func (s *readingStore) expire() error {
+	if s.retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-s.retention).UTC().Format(storeDayFormat)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*", "*.ndjson"))
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		day := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(name), ".ndjson"), "rollup-1m-")
+		if len(day) != len(storeDayFormat) {
+			// Hourly and daily rollups are kept forever.
+			continue
+		}
+		// Day names sort in time order.
+		if day < cutoff {
+			log.Printf("Removing expired readings %s", name)
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expireLoop periodically deletes expired readings. It never returns.
+func (s *readingStore) expireLoop(interval time.Duration) {
+	for {
+		if err := s.expire(); err != nil {
+			log.Printf("Could not remove expired readings: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
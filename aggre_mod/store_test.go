@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreCursor(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    storeCursor
+		invalid bool
+	}{
+		{s: "1792195200-0", want: storeCursor{1792195200, 0}},
+		{s: "1792195200-4096", want: storeCursor{1792195200, 4096}},
+		{s: "0-0", want: storeCursor{0, 0}},
+		{s: "", invalid: true},
+		{s: "1792195200", invalid: true},
+		{s: "abc-1", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			c, err := parseStoreCursor(tt.s)
+			if tt.invalid {
+				if err == nil {
+					t.Errorf("parseStoreCursor(%q) = %v, want an error", tt.s, c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c != tt.want {
+				t.Errorf("parseStoreCursor(%q) = %v, want %v", tt.s, c, tt.want)
+			}
+			if c.String() != tt.s {
+				t.Errorf("String() = %q, want %q", c.String(), tt.s)
+			}
+		})
+	}
+}
+
+// Paging through the readings of a device returns every reading once, in
+// timestamp order and then in the order they were stored in.
+func TestStoreQueryPaging(t *testing.T) {
+	const day = 1792195200
+	// The readings in the order they are stored.
+	stored := []struct {
+		id string
+		ts int64
+	}{
+		{"a", day + 100},
+		{"b", day + 100},
+		{"c", day + 50},
+		{"d", day + 86400 + 10},
+		{"e", day + 3*86400},
+	}
+
+	tests := []struct {
+		name  string
+		from  int64
+		to    int64
+		limit int
+		want  []string
+	}{
+		{"one per page", day, day + 4*86400, 1, []string{"c", "a", "b", "d", "e"}},
+		{"splits a timestamp", day, day + 4*86400, 2, []string{"c", "a", "b", "d", "e"}},
+		{"pages span days", day, day + 4*86400, 3, []string{"c", "a", "b", "d", "e"}},
+		{"single page", day, day + 4*86400, 10, []string{"c", "a", "b", "d", "e"}},
+		{"exact page", day, day + 4*86400, 5, []string{"c", "a", "b", "d", "e"}},
+		{"from excludes earlier", day + 100, day + 4*86400, 1, []string{"a", "b", "d", "e"}},
+		{"to excludes later", day, day + 86400 + 10, 2, []string{"c", "a", "b"}},
+		{"empty range", day + 2*86400, day + 3*86400, 2, []string{}},
+		{"all time", 0, math.MaxInt64, 2, []string{"c", "a", "b", "d", "e"}},
+		{"before the data", 0, day, 2, []string{}},
+		{"after the data", day + 4*86400, math.MaxInt64, 2, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := openStore(tempDir(t), 0, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The temperature identifies the reading.
+			for i, r := range stored {
+				if err := s.Write(&Reading{DeviceId: "dev", Timestamp: r.ts, Values: map[string]float64{"temp": float64(i)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := []string{}
+			var after *storeCursor
+			for pages := 0; ; pages++ {
+				if pages > len(stored) {
+					t.Fatalf("still paging after %d pages: %v", pages, got)
+				}
+				readings, next, err := s.Query("dev", tt.from, tt.to, after, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(readings) > tt.limit {
+					t.Fatalf("got %d readings, limit is %d", len(readings), tt.limit)
+				}
+				for _, r := range readings {
+					got = append(got, stored[int(r.Values["temp"])].id)
+				}
+				if next == nil {
+					break
+				}
+				// Clients resume with the cursor's string form.
+				c, err := parseStoreCursor(next.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				after = &c
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Device IDs that are special file names stay inside the store directory.
+func TestStoreDeviceDir(t *testing.T) {
+	const ts = 1792195200
+	parent := tempDir(t)
+	dir := filepath.Join(parent, "store")
+	s, err := openStore(dir, 0, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{".", "..", "a/b", "../x"}
+	for _, id := range ids {
+		if err := s.Write(&Reading{DeviceId: id, Timestamp: ts, Values: map[string]float64{"temp": 20}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "store" {
+		t.Errorf("files were written outside the store directory: %v", files)
+	}
+	got, err := s.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{".", "..", "../x", "a/b"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Devices() = %q, want %q", got, want)
+	}
+	for _, id := range ids {
+		readings, _, err := s.Query(id, ts, ts+1, nil, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(readings) != 1 {
+			t.Errorf("Query(%q) returned %d readings, want 1", id, len(readings))
+		}
+	}
+	if readings, next, err := s.Query("unknown", 0, math.MaxInt64, nil, 10); err != nil || len(readings) != 0 || next != nil {
+		t.Errorf("Query() of an unknown device = %v, %v, %v, want no readings", readings, next, err)
+	}
+}
@@ -0,0 +1,276 @@
+// stream.go implements the /api/stream endpoint which publishes every
+// reading and every change of a device's active state as Server-Sent Events.
+// Recent events are kept in memory so that clients can resume with the
+// Last-Event-ID header after reconnecting. Events are converted to the units
+// selected by each client when they are sent to it.
+//
+// Publishing never blocks the pipeline: each client has a bounded queue and
+// clients that fall behind are disconnected so that they resume from the
+// buffer.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// The channel that all events are published on. Events are also published
+// on a channel for each device.
+const streamChannelAll = "all"
+
+// The number of events a client may fall behind before it is disconnected.
+const streamClientQueueSize = 256
+
+// streamDeviceChannel returns the channel of a device's events.
+func streamDeviceChannel(id string) string {
+	return "device/" + id
+}
+
+// streamEvent is an event sent to stream clients.
+type streamEvent struct {
+	id     uint64
+	device string
+	event  string
+	data   string
+	// The reading record or device the data was encoded from.
+	value interface{}
+}
+
+// convert returns a copy of the event with the values in the selected units.
+func (e *streamEvent) convert(sel unitSelection) *streamEvent {
+	if len(sel) == 0 {
+		return e
+	}
+	var data interface{}
+	switch v := e.value.(type) {
+	case Device:
+		data = v.Record(sel)
+	case map[string]interface{}:
+		record := make(map[string]interface{})
+		for k, val := range v {
+			record[k] = val
+		}
+		sel.ConvertRecord(record)
+		data = record
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Could not convert stream event %d: %v", e.id, err)
+		return e
+	}
+	c := *e
+	c.data = string(b)
+	return &c
+}
+
+// writeTo writes the event in the text/event-stream format. The data is a
+// single line of JSON.
+func (e *streamEvent) writeTo(w http.ResponseWriter) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.event, e.data)
+	return err
+}
+
+// streamClient is a client connected to the stream.
+type streamClient struct {
+	channel string
+	units   unitSelection
+	// Events waiting to be sent. The channel is never closed.
+	queue chan *streamEvent
+	// lagging is closed when the client fell behind and must disconnect.
+	lagging chan struct{}
+}
+
+// readingStream is a Sink that publishes readings to stream clients. It also
+// keeps the most recent events for clients that resume.
+type readingStream struct {
+	mu sync.Mutex
+	// The ID of the last event published.
+	lastId uint64
+	// A ring buffer of recent events.
+	buffer []*streamEvent
+	next   int
+	// The connected clients.
+	clients map[*streamClient]bool
+}
+
+// newReadingStream creates a stream that keeps the last bufferSize events.
+func newReadingStream(bufferSize int) *readingStream {
+	return &readingStream{
+		buffer:  make([]*streamEvent, bufferSize),
+		clients: make(map[*streamClient]bool),
+	}
+}
+
+// send queues an event for the clients of the given channels without
+// blocking. Clients whose queue is full are disconnected. s.mu must be held.
+func (s *readingStream) send(channels []string, ev *streamEvent) {
+	for c := range s.clients {
+		for _, channel := range channels {
+			if c.channel != channel {
+				continue
+			}
+			select {
+			case c.queue <- ev:
+			default:
+				log.Printf("Disconnecting stream client that fell behind on %s", c.channel)
+				close(c.lagging)
+				delete(s.clients, c)
+			}
+		}
+	}
+}
+
+// publish sends an event with the given JSON data to the clients of all
+// events and of the device's events.
+func (s *readingStream) publish(device, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastId++
+	ev := &streamEvent{id: s.lastId, device: device, event: event, data: string(b), value: data}
+	if len(s.buffer) > 0 {
+		s.buffer[s.next] = ev
+		s.next = (s.next + 1) % len(s.buffer)
+	}
+
+	s.send([]string{streamChannelAll, streamDeviceChannel(device)}, ev)
+	return nil
+}
+
+func (s *readingStream) Name() string {
+	return "stream"
+}
+
+// Write publishes a reading as a reading event.
+func (s *readingStream) Write(r *Reading) error {
+	record := r.Record()
+	record["source"] = r.Source
+	return s.publish(r.DeviceId, "reading", record)
+}
+
+func (s *readingStream) Flush() error {
+	return nil
+}
+
+func (s *readingStream) Close() error {
+	return nil
+}
+
+func (s *readingStream) Health() error {
+	return nil
+}
+
+// PublishDevice publishes the state of a device whose active state changed
+// as a device event.
+func (s *readingStream) PublishDevice(d Device) {
+	if err := s.publish(d.Id, "device", d); err != nil {
+		log.Printf("Could not publish state of %s: %v", d.Id, err)
+	}
+}
+
+// replay returns the buffered events of a channel published after the event
+// with the given ID. s.mu must be held.
+func (s *readingStream) replay(channel, id string) []*streamEvent {
+	after, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	events := []*streamEvent{}
+	for i := 0; i < len(s.buffer); i++ {
+		ev := s.buffer[(s.next+i)%len(s.buffer)]
+		if ev == nil || ev.id <= after {
+			continue
+		}
+		if channel != streamChannelAll && channel != streamDeviceChannel(ev.device) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// subscribe adds a client of a channel and returns the buffered events
+// published after lastId so that no event is missed or sent twice.
+func (s *readingStream) subscribe(channel string, sel unitSelection, lastId string) (*streamClient, []*streamEvent) {
+	c := &streamClient{
+		channel: channel,
+		units:   sel,
+		queue:   make(chan *streamEvent, streamClientQueueSize),
+		lagging: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c] = true
+	return c, s.replay(channel, lastId)
+}
+
+// unsubscribe removes a client.
+func (s *readingStream) unsubscribe(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// Serves the event stream. If the device query parameter is set only the
+// events of that device are sent. Values are converted to the units given in
+// the units parameter.
+func (s *readingStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sel, err := parseUnitsParam(r.URL.Query().Get("units"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return
+	}
+	channel := streamChannelAll
+	if id := r.URL.Query().Get("device"); id != "" {
+		channel = streamDeviceChannel(id)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	h.Set("Connection", "keep-alive")
+	h.Set("Access-Control-Allow-Origin", "*")
+	// Don't let proxies buffer the stream.
+	h.Set("X-Accel-Buffering", "no")
+	flusher.Flush()
+
+	c, replayed := s.subscribe(channel, sel, r.Header.Get("Last-Event-ID"))
+	defer s.unsubscribe(c)
+	for _, ev := range replayed {
+		if err := ev.convert(c.units).writeTo(w); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case ev := <-c.queue:
+			if err := ev.convert(c.units).writeTo(w); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.lagging:
+			// The client resumes from the buffer after reconnecting.
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStreamEvents reads n events from an event stream and returns their IDs
+// and data.
+func readStreamEvents(t *testing.T, r *bufio.Reader, n int) []string {
+	events := []string{}
+	var id string
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read %v, then %v", events, err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			events = append(events, id+" "+strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return events
+}
+
+// Clients that resume with Last-Event-ID receive the buffered events they
+// missed and then the live events.
+func TestReadingStreamResume(t *testing.T) {
+	reading := func(id string, temp float64) *Reading {
+		return &Reading{Source: "mqtt", DeviceId: id, Timestamp: 1500000000, Values: map[string]float64{"temp": temp}}
+	}
+	tests := []struct {
+		name   string
+		query  string
+		lastId string
+		want   []string
+	}{
+		{
+			name: "new client",
+			want: []string{`5 {"deviceid":"b","source":"mqtt","temp":24,"timestamp":1500000000}`},
+		},
+		{
+			name:   "resume",
+			lastId: "2",
+			want: []string{
+				`3 {"deviceid":"a","source":"mqtt","temp":22,"timestamp":1500000000}`,
+				`4 {"deviceid":"b","source":"mqtt","temp":23,"timestamp":1500000000}`,
+				`5 {"deviceid":"b","source":"mqtt","temp":24,"timestamp":1500000000}`,
+			},
+		},
+		{
+			name:   "resume from before the buffer",
+			lastId: "0",
+			want: []string{
+				`2 {"deviceid":"a","source":"mqtt","temp":21,"timestamp":1500000000}`,
+				`3 {"deviceid":"a","source":"mqtt","temp":22,"timestamp":1500000000}`,
+				`4 {"deviceid":"b","source":"mqtt","temp":23,"timestamp":1500000000}`,
+				`5 {"deviceid":"b","source":"mqtt","temp":24,"timestamp":1500000000}`,
+			},
+		},
+		{
+			name:   "resume one device",
+			query:  "?device=a",
+			lastId: "0",
+			want: []string{
+				`2 {"deviceid":"a","source":"mqtt","temp":21,"timestamp":1500000000}`,
+				`3 {"deviceid":"a","source":"mqtt","temp":22,"timestamp":1500000000}`,
+				`6 {"deviceid":"a","source":"mqtt","temp":25,"timestamp":1500000000}`,
+			},
+		},
+		{
+			name:   "invalid ID",
+			lastId: "abc",
+			want:   []string{`5 {"deviceid":"b","source":"mqtt","temp":24,"timestamp":1500000000}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newReadingStream(3)
+			for i, id := range []string{"a", "a", "a", "b"} {
+				s.Write(reading(id, float64(20+i)))
+			}
+			server := httptest.NewServer(s)
+			defer server.Close()
+
+			req, err := http.NewRequest("GET", server.URL+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.lastId != "" {
+				req.Header.Set("Last-Event-ID", tt.lastId)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+				t.Errorf("Content-Type = %s", ct)
+			}
+
+			// The stream is subscribed once the headers are sent.
+			waitStreamClients(t, s, 1)
+			s.Write(reading("b", 24))
+			s.Write(reading("a", 25))
+			got := readStreamEvents(t, bufio.NewReader(resp.Body), len(tt.want))
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("received\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// waitStreamClients waits until n clients are connected to the stream.
+func waitStreamClients(t *testing.T, s *readingStream, n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		count := len(s.clients)
+		s.mu.Unlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d stream clients connected, want %d", count, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Publishing never blocks on a client that doesn't read. The client is
+// disconnected once its queue is full and can resume from the buffer.
+func TestReadingStreamLagging(t *testing.T) {
+	s := newReadingStream(10)
+	c, _ := s.subscribe(streamChannelAll, nil, "")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i <= streamClientQueueSize; i++ {
+			s.Write(&Reading{DeviceId: "dev", Timestamp: int64(i), Values: map[string]float64{"temp": 20}})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked on a client that doesn't read")
+	}
+
+	select {
+	case <-c.lagging:
+	default:
+		t.Fatal("client that fell behind wasn't disconnected")
+	}
+	if len(c.queue) != streamClientQueueSize {
+		t.Errorf("%d events queued, want %d", len(c.queue), streamClientQueueSize)
+	}
+	waitStreamClients(t, s, 0)
+
+	// The event that didn't fit is sent when the client resumes after the
+	// last event it received.
+	s.mu.Lock()
+	missed := s.replay(streamChannelAll, fmt.Sprint(streamClientQueueSize))
+	s.mu.Unlock()
+	if len(missed) != 1 || missed[0].id != streamClientQueueSize+1 {
+		t.Errorf("resuming returned %d events, want event %d", len(missed), streamClientQueueSize+1)
+	}
+}
+
+// Each client receives values in the units it selected.
+func TestReadingStreamUnits(t *testing.T) {
+	s := newReadingStream(10)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", `1 {"deviceid":"dev","source":"mqtt","temp":20,"timestamp":1500000000}`},
+		{"?units=imperial", `1 {"deviceid":"dev","source":"mqtt","temp":68,"timestamp":1500000000}`},
+		{"?units=temp:kelvin", `1 {"deviceid":"dev","source":"mqtt","temp":293.15,"timestamp":1500000000}`},
+	}
+	readers := []*bufio.Reader{}
+	for _, tt := range tests {
+		resp, err := http.Get(server.URL + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		readers = append(readers, bufio.NewReader(resp.Body))
+	}
+	waitStreamClients(t, s, len(tests))
+	s.Write(&Reading{Source: "mqtt", DeviceId: "dev", Timestamp: 1500000000, Values: map[string]float64{"temp": 20}})
+	for i, tt := range tests {
+		if got := readStreamEvents(t, readers[i], 1); got[0] != tt.want {
+			t.Errorf("%s received %s, want %s", tt.query, got[0], tt.want)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "?units=furlongs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid units returned %s, want 400", resp.Status)
+	}
+}
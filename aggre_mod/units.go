@@ -0,0 +1,172 @@
+// units.go implements converting metric values between units. Values are
+// stored and sent to the outputs in the unit of their metric and converted
+// when they are read from the API, e.g. with ?units=imperial.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// unit is a unit that values can be converted from and to. Values are
+// converted to the base unit of the quantity as val*scale + offset.
+type unit struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+// The units that values can be converted between. The base units are
+// celsius, hPa, m/s and mm.
+var knownUnits = map[string]unit{
+	"celsius":    {"temperature", 1, 0},
+	"fahrenheit": {"temperature", 5.0 / 9, -32 * 5.0 / 9},
+	"kelvin":     {"temperature", 1, -273.15},
+	"hPa":        {"pressure", 1, 0},
+	"kPa":        {"pressure", 10, 0},
+	"inHg":       {"pressure", 33.8639, 0},
+	"mmHg":       {"pressure", 1.33322, 0},
+	"m/s":        {"speed", 1, 0},
+	"km/h":       {"speed", 1 / 3.6, 0},
+	"mph":        {"speed", 0.44704, 0},
+	"knots":      {"speed", 0.514444, 0},
+	"mm":         {"length", 1, 0},
+	"in":         {"length", 25.4, 0},
+}
+
+// The units of each quantity in the systems that can be selected with
+// ?units=.
+var unitSystems = map[string]map[string]string{
+	"metric": {
+		"temperature": "celsius",
+		"pressure":    "hPa",
+		"speed":       "m/s",
+		"length":      "mm",
+	},
+	"imperial": {
+		"temperature": "fahrenheit",
+		"pressure":    "inHg",
+		"speed":       "mph",
+		"length":      "in",
+	},
+}
+
+// convertUnit converts a value between two units of the same quantity.
+func convertUnit(val float64, from, to string) float64 {
+	f, t := knownUnits[from], knownUnits[to]
+	base := val*f.scale + f.offset
+	// Round off the noise of the floating point arithmetic.
+	return math.Round((base-t.offset)/t.scale*1e6) / 1e6
+}
+
+// unitSelection maps the names of metrics whose values are converted to the
+// unit they are converted to. A nil selection converts nothing.
+type unitSelection map[string]string
+
+// parseUnitsParam parses a comma separated list of unit systems (metric or
+// imperial) and metric:unit pairs, e.g. "imperial,pressure:hPa". Later
+// entries take precedence. An empty string selects the units of the
+// metrics.
+func parseUnitsParam(s string) (unitSelection, error) {
+	if s == "" {
+		return nil, nil
+	}
+	sel := make(unitSelection)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if i := strings.Index(item, ":"); i >= 0 {
+			m := metrics.Get(item[:i])
+			if m == nil {
+				return nil, fmt.Errorf("unknown metric %q", item[:i])
+			}
+			to, ok := knownUnits[item[i+1:]]
+			from, convertible := knownUnits[m.Unit]
+			if !ok {
+				return nil, fmt.Errorf("unknown unit %q", item[i+1:])
+			}
+			if !convertible || from.quantity != to.quantity {
+				return nil, fmt.Errorf("%s can't be converted to %s", m.Name, item[i+1:])
+			}
+			sel[m.Name] = item[i+1:]
+			continue
+		}
+
+		system, ok := unitSystems[item]
+		if !ok {
+			return nil, fmt.Errorf("unknown unit system %q", item)
+		}
+		for _, m := range metrics.Metrics {
+			if to, ok := system[knownUnits[m.Unit].quantity]; ok {
+				sel[m.Name] = to
+			}
+		}
+	}
+	// Leave out the metrics that are already in the selected unit.
+	for _, m := range metrics.Metrics {
+		if sel[m.Name] == m.Unit {
+			delete(sel, m.Name)
+		}
+	}
+	return sel, nil
+}
+
+// String returns the selection in the format parsed by parseUnitsParam.
+func (sel unitSelection) String() string {
+	list := []string{}
+	for name, to := range sel {
+		list = append(list, name+":"+to)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// Unit returns the unit that values of a metric are shown in.
+func (sel unitSelection) Unit(m *Metric) string {
+	return stringDefaults(m.Unit, sel[m.Name])
+}
+
+// Units returns the units of the metrics that have one.
+func (sel unitSelection) Units(list []*Metric) map[string]string {
+	units := make(map[string]string)
+	for _, m := range list {
+		if u := sel.Unit(m); u != "" {
+			units[m.Name] = u
+		}
+	}
+	return units
+}
+
+// Convert converts a value of a metric to the selected unit.
+func (sel unitSelection) Convert(m *Metric, val float64) float64 {
+	if to, ok := sel[m.Name]; ok {
+		return convertUnit(val, m.Unit, to)
+	}
+	return val
+}
+
+// Value returns a value of a metric in the selected unit as it should
+// appear in records. Converted values of INTEGER metrics aren't truncated.
+func (sel unitSelection) Value(m *Metric, val float64) interface{} {
+	if _, ok := sel[m.Name]; ok {
+		return sel.Convert(m, val)
+	}
+	return m.Value(val)
+}
+
+// ConvertRecord converts the metric values of a record in place.
+func (sel unitSelection) ConvertRecord(record map[string]interface{}) {
+	for _, m := range metrics.Metrics {
+		if _, ok := sel[m.Name]; !ok {
+			continue
+		}
+		switch val := record[m.Name].(type) {
+		case float64:
+			record[m.Name] = sel.Convert(m, val)
+		case int64:
+			record[m.Name] = sel.Convert(m, float64(val))
+		}
+	}
+}
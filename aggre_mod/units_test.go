@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		val      float64
+		from, to string
+		want     float64
+	}{
+		{20, "celsius", "celsius", 20},
+		{0, "celsius", "fahrenheit", 32},
+		{100, "celsius", "fahrenheit", 212},
+		{-40, "celsius", "fahrenheit", -40},
+		{68, "fahrenheit", "celsius", 20},
+		{0, "celsius", "kelvin", 273.15},
+		{0, "kelvin", "fahrenheit", -459.67},
+		{1013.25, "hPa", "kPa", 101.325},
+		{1013.25, "hPa", "inHg", 29.921244},
+		{1013.25, "hPa", "mmHg", 760.002100},
+		{10, "m/s", "km/h", 36},
+		{10, "m/s", "mph", 22.369363},
+		{10, "knots", "m/s", 5.14444},
+		{25.4, "mm", "in", 1},
+		{2, "in", "mm", 50.8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%g %s to %s", tt.val, tt.from, tt.to), func(t *testing.T) {
+			if got := convertUnit(tt.val, tt.from, tt.to); got != tt.want {
+				t.Errorf("convertUnit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUnitsParam(t *testing.T) {
+	tests := []struct {
+		param string
+		// The selection's String or the error.
+		want string
+		err  string
+	}{
+		{"", "", ""},
+		{"metric", "", ""},
+		{"imperial", "pressure:inHg,rainfall:in,temp:fahrenheit,windspeed:mph", ""},
+		{"imperial,pressure:hPa", "rainfall:in,temp:fahrenheit,windspeed:mph", ""},
+		{"pressure:hPa,imperial", "pressure:inHg,rainfall:in,temp:fahrenheit,windspeed:mph", ""},
+		{"temp:kelvin", "temp:kelvin", ""},
+		{" temp:kelvin , windspeed:knots ", "temp:kelvin,windspeed:knots", ""},
+		{"imperial,metric", "", ""},
+		{"temperature:kelvin", "", `unknown metric "temperature"`},
+		{"temp:rankine", "", `unknown unit "rankine"`},
+		{"temp:mph", "", "temp can't be converted to mph"},
+		{"humidity:in", "", "humidity can't be converted to in"},
+		{"nautical", "", `unknown unit system "nautical"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.param, func(t *testing.T) {
+			sel, err := parseUnitsParam(tt.param)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("parseUnitsParam() error = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sel.String(); got != tt.want {
+				t.Errorf("parseUnitsParam() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnitSelectionConvertRecord(t *testing.T) {
+	tests := []struct {
+		param  string
+		record map[string]interface{}
+		want   string
+	}{
+		{"", map[string]interface{}{"temp": 20.0, "humidity": 40.0}, "map[humidity:40 temp:20]"},
+		{"imperial", map[string]interface{}{"temp": 20.0, "humidity": 40.0, "pressure": 1000.0}, "map[humidity:40 pressure:29.529971 temp:68]"},
+		{"temp:kelvin", map[string]interface{}{"temp": int64(20), "deviceid": "dev"}, "map[deviceid:dev temp:293.15]"},
+		{"imperial", map[string]interface{}{"temp": nil, "timestamp": int64(1500000000)}, "map[temp:<nil> timestamp:1500000000]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.param, func(t *testing.T) {
+			sel, err := parseUnitsParam(tt.param)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sel.ConvertRecord(tt.record)
+			if got := fmt.Sprint(tt.record); got != tt.want {
+				t.Errorf("ConvertRecord() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
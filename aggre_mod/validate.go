@@ -0,0 +1,85 @@
+// validate.go implements the plausibility rules that readings are checked
+// against before they are written to the outputs. Readings with a value that
+// fails a rule are quarantined: they are only written to the quarantine
+// outputs, annotated with the metric and rule that failed, so that failed
+// sensor reads don't end up with the real data.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// The names of the validation rules.
+const (
+	ruleNaN     = "nan"
+	ruleInf     = "inf"
+	ruleInvalid = "invalid"
+	ruleMin     = "min"
+	ruleMax     = "max"
+)
+
+// readingRejection describes why a reading was quarantined.
+type readingRejection struct {
+	Metric string
+	Rule   string
+	// Message describes the failure for logs.
+	Message string
+}
+
+// check returns the rule that a value of the metric fails and a description
+// of the failure. The rule is empty if the value is valid.
+func (m *Metric) check(val float64) (string, string) {
+	switch {
+	case math.IsNaN(val):
+		return ruleNaN, "value is NaN"
+	case math.IsInf(val, 0):
+		return ruleInf, "value is infinite"
+	}
+	for _, invalid := range m.Invalid {
+		if val == invalid {
+			return ruleInvalid, fmt.Sprintf("%v is a known invalid value", val)
+		}
+	}
+	if m.Min != nil && val < *m.Min {
+		return ruleMin, fmt.Sprintf("%v is below the minimum of %v", val, *m.Min)
+	}
+	if m.Max != nil && val > *m.Max {
+		return ruleMax, fmt.Sprintf("%v is above the maximum of %v", val, *m.Max)
+	}
+	return "", ""
+}
+
+// validateReading checks the values of a reading against the rules of their
+// metrics. It returns nil if the reading is valid or the first failure.
+func validateReading(r *Reading) *readingRejection {
+	for _, m := range metrics.Metrics {
+		val, ok := r.Values[m.Name]
+		if !ok {
+			continue
+		}
+		if rule, msg := m.check(val); rule != "" {
+			quarantined.Inc(m.Name, rule)
+			return &readingRejection{Metric: m.Name, Rule: rule, Message: msg}
+		}
+	}
+	return nil
+}
+
+// quarantineSink wraps a sink that quarantined readings are written to.
+type quarantineSink struct {
+	Sink
+}
+
+func (s *quarantineSink) Name() string {
+	return "quarantine/" + s.Sink.Name()
+}
+
+// sinkAccepts returns true if a reading should be written to a sink.
+// Quarantined readings are only written to quarantine sinks and other
+// readings only to the other sinks.
+func sinkAccepts(s Sink, r *Reading) bool {
+	_, quarantine := s.(*quarantineSink)
+	return quarantine == (r.Rejection != nil)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMetricCheck(t *testing.T) {
+	humidity := metrics.Get("humidity")
+	tests := []struct {
+		m    *Metric
+		val  float64
+		rule string
+	}{
+		{humidity, 45, ""},
+		{humidity, 0, ""},
+		{humidity, 100, ""},
+		{humidity, -4, ruleInvalid},
+		{humidity, -0.5, ruleMin},
+		{humidity, 100.5, ruleMax},
+		{humidity, math.NaN(), ruleNaN},
+		{humidity, math.Inf(-1), ruleInf},
+		{&Metric{Name: "rssi"}, -120, ""},
+		{&Metric{Name: "rssi"}, math.Inf(1), ruleInf},
+	}
+	for _, tt := range tests {
+		rule, msg := tt.m.check(tt.val)
+		if rule != tt.rule {
+			t.Errorf("check(%v) of %s = %q, want %q", tt.val, tt.m.Name, rule, tt.rule)
+		}
+		if (msg == "") != (rule == "") {
+			t.Errorf("check(%v) of %s returned message %q for rule %q", tt.val, tt.m.Name, msg, rule)
+		}
+	}
+}
+
+func TestValidateReading(t *testing.T) {
+	tests := []struct {
+		values map[string]float64
+		want   *readingRejection
+	}{
+		{map[string]float64{"temp": 21.5, "humidity": 45}, nil},
+		{map[string]float64{"temp": 21.5, "humidity": -4}, &readingRejection{Metric: "humidity", Rule: ruleInvalid}},
+		{map[string]float64{"temp": 120, "humidity": 45}, &readingRejection{Metric: "temp", Rule: ruleMax}},
+		{map[string]float64{}, nil},
+	}
+	for _, tt := range tests {
+		got := validateReading(&Reading{DeviceId: "dev", Values: tt.values})
+		switch {
+		case got == nil && tt.want == nil:
+		case got == nil || tt.want == nil || got.Metric != tt.want.Metric || got.Rule != tt.want.Rule:
+			t.Errorf("validateReading(%v) = %+v, want %+v", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestSinkAccepts(t *testing.T) {
+	sink := &testSink{name: "test"}
+	quarantine := &quarantineSink{&testSink{name: "test"}}
+	valid := &Reading{DeviceId: "dev"}
+	rejected := &Reading{DeviceId: "dev", Rejection: &readingRejection{Metric: "humidity", Rule: ruleInvalid}}
+
+	if !sinkAccepts(sink, valid) {
+		t.Error("sink doesn't accept a valid reading")
+	}
+	if sinkAccepts(sink, rejected) {
+		t.Error("sink accepts a quarantined reading")
+	}
+	if sinkAccepts(quarantine, valid) {
+		t.Error("quarantine sink accepts a valid reading")
+	}
+	if !sinkAccepts(quarantine, rejected) {
+		t.Error("quarantine sink doesn't accept a quarantined reading")
+	}
+	if quarantine.Name() != "quarantine/test" {
+		t.Errorf("Name() = %s, want quarantine/test", quarantine.Name())
+	}
+}